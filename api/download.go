@@ -0,0 +1,294 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+// errDownloadRefused stops http.ServeContent once the response was replaced
+// by a problem.
+var errDownloadRefused = errors.New("download refused")
+
+// countingWriter records the status, range and body bytes of a response so
+// srvBlob can tell what a GET delivered, and reports the offset reached to
+// meter when set. When admit is set it sees the range before any header is
+// sent and may refuse the response, which is then answered with a 410.
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	start   int64 // blob offset of the first body byte
+	meter   *progressMeter
+
+	id      storage.ObjectID
+	size    int64 // blob size
+	span    span  // range the response carries, if known
+	known   bool  // false for errors and multipart/byteranges
+	admit   func(span) bool
+	refused bool
+}
+
+func (cw *countingWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	switch status {
+	case http.StatusOK:
+		cw.span, cw.known = span{0, cw.size}, true
+	case http.StatusPartialContent:
+		cw.start = rangeStart(cw.Header())
+		var start, end, total int64
+		if _, err := fmt.Sscanf(cw.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err == nil && total == cw.size {
+			cw.span, cw.known = span{start, end + 1}, true
+		}
+	}
+	if cw.admit != nil && cw.known && !cw.admit(cw.span) {
+		cw.refused = true
+		h := cw.Header()
+		for _, k := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag"} {
+			h.Del(k)
+		}
+		writeProblem(cw.ResponseWriter, h.Get("X-Request-ID"), 410, "NC_DOWNLOAD_LIMIT", "Download limit reached", "",
+			map[string]any{"objectId": cw.id})
+		return
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.refused {
+		return 0, errDownloadRefused
+	}
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	if cw.meter != nil && n > 0 {
+		cw.meter.report(cw.start + cw.written)
+	}
+	return n, err
+}
+
+// delivered reports whether the whole range of the response went out.
+func (cw *countingWriter) delivered() bool {
+	return !cw.refused && cw.known && cw.written == cw.span.len()
+}
+
+// span is a byte range [start, end) of a blob.
+type span struct{ start, end int64 }
+
+func (s span) len() int64 { return s.end - s.start }
+
+const (
+	maxFetchedSpans = 64        // disjoint ranges remembered per requester
+	fetchedTTL      = time.Hour // how long an unfinished download is remembered
+)
+
+// downloadIDHeader carries the id that ties the Range requests of one
+// download together; see downloadKeys.
+const downloadIDHeader = "X-Download-ID"
+
+// downloadKeys names the requester whose Range requests add up to one
+// download of a limited object. A client echoing the X-Download-ID of an
+// earlier response is tracked by that id alone. Otherwise a fresh id is
+// issued and the response also counts towards the client address, so that
+// clients which never echo it can still resume, at the cost of sharing
+// progress with others behind the same address.
+func (s *Server) downloadKeys(w http.ResponseWriter, r *http.Request) []string {
+	if id := r.Header.Get(downloadIDHeader); validDownloadID(id) {
+		w.Header().Set(downloadIDHeader, id)
+		return []string{"dl:" + id}
+	}
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+	w.Header().Set(downloadIDHeader, id)
+	return []string{"ip:" + s.RateLimit.Proxies.ClientIP(r), "dl:" + id}
+}
+
+// validDownloadID accepts up to 64 URL-safe base64 characters.
+func validDownloadID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// downloads decides which GETs count against an object's download limit. A
+// download counts once a requester (see downloadKeys) has fetched every byte
+// of the blob, over any number of Range requests, so resuming works while
+// probes of single ranges never count. A response that would complete a
+// download of a limited object holds one of its remaining slots while it
+// streams, and is refused when none is left, so concurrent GETs cannot
+// exceed the limit.
+type downloads struct {
+	mu        sync.Mutex
+	fetched   map[fetchKey]*fetched
+	held      map[storage.ObjectID]int
+	counted   map[storage.ObjectID]counted // Downloads as of the last RecordDownload
+	lastSweep time.Time
+}
+
+type fetchKey struct {
+	id  storage.ObjectID
+	who string // one of downloadKeys
+}
+
+type fetched struct {
+	spans []span // sorted, disjoint, not adjacent
+	at    time.Time
+}
+
+type counted struct {
+	n  int
+	at time.Time
+}
+
+// admit is called before a response carrying sp of meta's blob is sent to
+// the requester named by keys. It reports whether the response may go out,
+// and whether it holds a slot that finish must release.
+func (d *downloads) admit(id storage.ObjectID, keys []string, sp span, meta storage.Meta) (ok, held bool) {
+	if meta.MaxDownloads <= 0 {
+		return true, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	complete := false
+	for _, who := range keys {
+		var spans []span
+		if f := d.fetched[fetchKey{id, who}]; f != nil {
+			spans = f.spans
+		}
+		complete = complete || covers(addSpan(spans, sp), meta.Size)
+	}
+	if !complete {
+		return true, false
+	}
+	used := max(meta.Downloads, d.counted[id].n) + d.held[id]
+	if used >= meta.MaxDownloads {
+		return false, false
+	}
+	if d.held == nil {
+		d.held = make(map[storage.ObjectID]int)
+	}
+	d.held[id]++
+	return true, true
+}
+
+// finish records that the requester named by keys was sent sp in full, if
+// ok, and reports whether that completed a download. A slot held by a
+// response that did not complete one is released; otherwise the caller
+// records the download and calls recorded.
+func (d *downloads) finish(id storage.ObjectID, keys []string, sp span, ok bool, size int64, held bool) bool {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweepLocked(now)
+	complete := false
+	if ok {
+		for _, who := range keys {
+			k := fetchKey{id, who}
+			f := d.fetched[k]
+			if f == nil {
+				f = &fetched{}
+			}
+			spans := addSpan(f.spans, sp)
+			switch {
+			case covers(spans, size):
+				complete = true
+			case len(spans) <= maxFetchedSpans:
+				f.spans, f.at = spans, now
+				if d.fetched == nil {
+					d.fetched = make(map[fetchKey]*fetched)
+				}
+				d.fetched[k] = f
+			}
+		}
+		if complete {
+			for _, who := range keys {
+				delete(d.fetched, fetchKey{id, who})
+			}
+		}
+	}
+	if held && !complete {
+		d.releaseLocked(id)
+	}
+	return complete
+}
+
+// recorded releases the slot of a completed download once the store has
+// counted it, remembering the count for responses admitted on older metas.
+func (d *downloads) recorded(id storage.ObjectID, m storage.Meta, held bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m.Downloads > d.counted[id].n {
+		if d.counted == nil {
+			d.counted = make(map[storage.ObjectID]counted)
+		}
+		d.counted[id] = counted{m.Downloads, time.Now()}
+	}
+	if held {
+		d.releaseLocked(id)
+	}
+}
+
+func (d *downloads) releaseLocked(id storage.ObjectID) {
+	if d.held[id]--; d.held[id] <= 0 {
+		delete(d.held, id)
+	}
+}
+
+// sweepLocked drops unfinished downloads nobody resumed for fetchedTTL, and
+// counts older than any meta a request could still be acting on.
+func (d *downloads) sweepLocked(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+	for k, f := range d.fetched {
+		if now.Sub(f.at) > fetchedTTL {
+			delete(d.fetched, k)
+		}
+	}
+	for id, c := range d.counted {
+		if d.held[id] == 0 && now.Sub(c.at) > time.Minute {
+			delete(d.counted, id)
+		}
+	}
+}
+
+// addSpan returns spans, sorted and disjoint, with sp merged in.
+func addSpan(spans []span, sp span) []span {
+	out := spans[:0:0]
+	for _, s := range spans {
+		switch {
+		case s.end < sp.start:
+			out = append(out, s)
+		case sp.end < s.start:
+			out = append(out, sp)
+			sp = s
+		default:
+			sp = span{min(s.start, sp.start), max(s.end, sp.end)}
+		}
+	}
+	return append(out, sp)
+}
+
+func covers(spans []span, size int64) bool {
+	return len(spans) == 1 && spans[0].start <= 0 && spans[0].end >= size
+}
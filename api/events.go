@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+// Notifier delivers frames to the peers of a hub room; *hub.Hub satisfies it.
+type Notifier interface {
+	BroadcastEvent(appID string, evt any)
+}
+
+// Object event names, the "event" member of an ObjectEvent frame.
+const (
+	EventCreated    = "created"
+	EventProgress   = "progress"
+	EventCommitted  = "committed"
+	EventDownloaded = "downloaded"
+	EventDeleted    = "deleted"
+	EventExpired    = "expired"
+)
+
+// ObjectEvent is the frame sent to the room an object was linked to at
+// create time, so receivers need not poll for commit.
+type ObjectEvent struct {
+	Type      string           `json:"type"` // "object"
+	Event     string           `json:"event"`
+	ObjectID  storage.ObjectID `json:"objectId"`
+	State     storage.State    `json:"state"`
+	Size      int64            `json:"size,omitempty"`
+	ETag      string           `json:"etag,omitempty"`
+	Direction string           `json:"direction,omitempty"` // progress: "upload" or "download"
+	Bytes     int64            `json:"bytes,omitempty"`     // progress: see transfer.Bytes
+	Total     int64            `json:"total,omitempty"`     // progress: expected bytes, when known
+	Downloads int              `json:"downloads,omitempty"`
+	ExpiresAt time.Time        `json:"expiresAt,omitzero"`
+}
+
+// publish sends event about id to its room, if it has one, and keeps the
+// expiry timer in step with the meta.
+func (s *Server) publish(event string, id storage.ObjectID, m storage.Meta) {
+	s.publishEvent(id, m, ObjectEvent{Event: event})
+}
+
+// publishEvent fills in evt from m and sends it.
+func (s *Server) publishEvent(id storage.ObjectID, m storage.Meta, evt ObjectEvent) {
+	if m.State.Terminal() {
+		s.progress.forget(id)
+	}
+	if s.Events == nil || m.Room == "" {
+		return
+	}
+	evt.Type = "object"
+	evt.ObjectID = id
+	evt.State = m.State
+	evt.Size = m.Size
+	evt.ETag = m.ETag
+	evt.Downloads = m.Downloads
+	evt.ExpiresAt = m.ExpiresAt
+	s.Events.BroadcastEvent(m.Room, evt)
+	s.watchExpiry(id, m)
+}
+
+// expiryWatch arms one timer per linked live object so its room hears about
+// expiry when it happens rather than on the next access.
+type expiryWatch struct {
+	mu     sync.Mutex
+	timers map[storage.ObjectID]*time.Timer
+}
+
+func (s *Server) watchExpiry(id storage.ObjectID, m storage.Meta) {
+	w := &s.expiry
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t := w.timers[id]; t != nil {
+		t.Stop()
+		delete(w.timers, id)
+	}
+	// Uploading objects are rescheduled when the stream ends.
+	if m.State.Terminal() || m.ExpiresAt.IsZero() || !m.ExpiresAt.After(time.Now()) {
+		return
+	}
+	if w.timers == nil {
+		w.timers = make(map[storage.ObjectID]*time.Timer)
+	}
+	room := m.Room
+	w.timers[id] = time.AfterFunc(time.Until(m.ExpiresAt), func() { s.checkExpired(id, room) })
+}
+
+// checkExpired runs when a watched object's ExpiresAt passes. Stat applies
+// the expiry; an object kept alive meanwhile is watched again.
+func (s *Server) checkExpired(id storage.ObjectID, room string) {
+	m, err := s.Store.StatBlob(context.Background(), id)
+	if err != nil {
+		s.expiry.mu.Lock()
+		delete(s.expiry.timers, id)
+		s.expiry.mu.Unlock()
+		return
+	}
+	m.Room = room
+	if m.State == storage.StateExpired {
+		s.publish(EventExpired, id, m)
+		return
+	}
+	s.watchExpiry(id, m)
+}
+
+// watchLinked arms expiry timers for the linked objects a store already
+// holds, e.g. after a restart.
+func (s *Server) watchLinked() {
+	l, ok := s.Store.(storage.Lister)
+	if !ok || s.Events == nil {
+		return
+	}
+	_ = l.List(storage.Query{}, func(id storage.ObjectID, m storage.Meta) bool {
+		if m.Room != "" {
+			s.watchExpiry(id, m)
+		}
+		return true
+	})
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// DefaultManifestMax is the manifest size limit when none is configured.
+const DefaultManifestMax = 1 << 20
+
+// ManifestPolicy decides which manifests PUT /objects/{id}/manifest accepts.
+// Manifests must always be well-formed JSON within MaxBytes.
+type ManifestPolicy struct {
+	MaxBytes int64 // 0 means DefaultManifestMax
+
+	// Schemas maps a manifest format version to the JSON Schema it must
+	// satisfy. When non-empty, every manifest must be an object whose
+	// "version" names one of them.
+	Schemas map[string]*jsonschema.Schema
+}
+
+func (p ManifestPolicy) maxBytes() int64 {
+	if p.MaxBytes > 0 {
+		return p.MaxBytes
+	}
+	return DefaultManifestMax
+}
+
+// LoadManifestSchemas compiles every v<version>.json in dir, e.g. v1.json
+// for manifests with "version": 1.
+func LoadManifestSchemas(dir string) (map[string]*jsonschema.Schema, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "v*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no v<version>.json schemas in %s", dir)
+	}
+	c := jsonschema.NewCompiler()
+	schemas := make(map[string]*jsonschema.Schema, len(paths))
+	for _, p := range paths {
+		version := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), "v"), ".json")
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := jsonschema.UnmarshalJSON(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		loc := "urn:noisytransfer:manifest:v" + version
+		if err := c.AddResource(loc, doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if schemas[version], err = c.Compile(loc); err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return schemas, nil
+}
+
+// manifestProblem is a rejected manifest, rendered as a problem response.
+type manifestProblem struct {
+	status       int
+	code, title  string
+	detail       string
+	version      string
+	schemaErrors []string
+}
+
+// readManifest reads at most the policy's limit from r and validates it.
+func (p ManifestPolicy) readManifest(r io.Reader) ([]byte, *manifestProblem) {
+	limit := p.maxBytes()
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, &manifestProblem{status: 400, code: "NC_BAD_REQUEST", title: "Manifest read failed", detail: err.Error()}
+	}
+	if int64(len(b)) > limit {
+		return nil, &manifestProblem{status: 413, code: "NC_MANIFEST_TOO_LARGE", title: "Manifest too large",
+			detail: fmt.Sprintf("manifest exceeds %d bytes", limit)}
+	}
+	if !json.Valid(b) {
+		return nil, &manifestProblem{status: 400, code: "NC_MANIFEST_MALFORMED", title: "Manifest is not valid JSON",
+			detail: jsonSyntaxDetail(b)}
+	}
+	if len(p.Schemas) == 0 {
+		return b, nil
+	}
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(b))
+	if err != nil {
+		return nil, &manifestProblem{status: 400, code: "NC_MANIFEST_MALFORMED", title: "Manifest is not valid JSON", detail: err.Error()}
+	}
+	version, ok := manifestVersion(doc)
+	sch := p.Schemas[version]
+	if !ok || sch == nil {
+		return nil, &manifestProblem{status: 422, code: "NC_MANIFEST_INVALID", title: "Unsupported manifest version",
+			detail: "manifest must be an object with a supported \"version\"", version: version}
+	}
+	if err := sch.Validate(doc); err != nil {
+		mp := &manifestProblem{status: 422, code: "NC_MANIFEST_INVALID", title: "Manifest does not match its schema",
+			detail: "manifest does not match schema v" + version, version: version}
+		var ve *jsonschema.ValidationError
+		if errors.As(err, &ve) {
+			for _, u := range ve.BasicOutput().Errors {
+				if u.Error != nil {
+					mp.schemaErrors = append(mp.schemaErrors, u.InstanceLocation+": "+u.Error.String())
+				}
+			}
+		}
+		return nil, mp
+	}
+	return b, nil
+}
+
+// manifestVersion returns the "version" member of a manifest object; both
+// 1 and "1" name version 1.
+func manifestVersion(doc any) (string, bool) {
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	switch v := obj["version"].(type) {
+	case string:
+		return v, v != ""
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// jsonSyntaxDetail locates the first syntax error for the problem detail.
+func jsonSyntaxDetail(b []byte) string {
+	var v any
+	err := json.Unmarshal(b, &v)
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		return fmt.Sprintf("%s at offset %d", se.Error(), se.Offset)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "invalid JSON"
+}
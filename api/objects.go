@@ -1,50 +1,144 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
+
 	"github.com/collapsinghierarchy/noisytransfer/storage"
 )
 
 type Server struct {
 	Store   storage.Store
-	BaseURL string        // e.g., http://localhost:8080
-	TTL     time.Duration // GC TTL
+	BaseURL string // e.g., http://localhost:8080
+	Policy  Policy
+	Quota   Quota
+
+	Manifest ManifestPolicy
+
+	// Events, when set, receives lifecycle events of objects created with
+	// an appID, addressed to that hub room.
+	Events Notifier
+
+	RateLimit RateLimit
+
+	inflight  inflight
+	expiry    expiryWatch
+	progress  progressTracker
+	downloads downloads
 }
 
 func (s *Server) Register(mux *http.ServeMux) {
-	mux.HandleFunc("/objects", s.handleObjects)
-	mux.HandleFunc("/objects/", s.handleObject)
+	mux.HandleFunc("/objects", s.limited(s.handleObjects))
+	mux.HandleFunc("/objects/", s.limited(s.handleObject))
+	mux.HandleFunc("/usage", s.limited(s.srvUsage))
 }
 
 func (s *Server) handleObjects(w http.ResponseWriter, r *http.Request) {
 	rid := newRID(w)
 	switch r.Method {
 	case http.MethodPost:
-		id, err := s.Store.Create(r.Context())
+		var req createRequest
+		if err := decodeOptionalJSON(r, &req); err != nil {
+			writeProblem(w, rid, 400, "NC_BAD_REQUEST", "Invalid create request", err.Error(), nil)
+			return
+		}
+		if req.MaxDownloads < 0 {
+			writeProblem(w, rid, 400, "NC_BAD_REQUEST", "Invalid create request", "maxDownloads must be >= 0", nil)
+			return
+		}
+		if req.TTL < 0 {
+			writeProblem(w, rid, 400, "NC_BAD_REQUEST", "Invalid create request", "ttl must be >= 0", nil)
+			return
+		}
+		if !req.ExpiresAt.IsZero() && !req.ExpiresAt.After(time.Now()) {
+			writeProblem(w, rid, 400, "NC_BAD_REQUEST", "Invalid create request", "expiresAt must be in the future", nil)
+			return
+		}
+		if req.AppID != "" {
+			if _, err := uuid.Parse(req.AppID); err != nil {
+				writeProblem(w, rid, 400, "NC_BAD_REQUEST", "Invalid create request", "appID must be a UUID", nil)
+				return
+			}
+		}
+		if s.full() {
+			writeProblem(w, rid, 507, "NC_INSUFFICIENT_STORAGE", "Insufficient storage", errFull.Error(), nil)
+			return
+		}
+		// Presenting an earlier ownerToken files the object under the same
+		// owner, which is what per-owner quotas count.
+		token := bearerToken(r)
+		hash := hashOwnerToken(token)
+		if token == "" {
+			var err error
+			if token, hash, err = newOwnerToken(); err != nil {
+				writeProblem(w, rid, 500, "NC_STORE_CREATE", "Create failed", err.Error(), nil)
+				return
+			}
+		}
+		opts := s.Policy.createOptions(req, time.Now())
+		opts.OwnerHash = hash
+		opts.Room = req.AppID
+		opts.Client = clientDigest(s.RateLimit.Proxies.ClientIP(r))
+		id, err := s.Store.Create(r.Context(), opts)
 		if err != nil {
 			writeProblem(w, rid, 500, "NC_STORE_CREATE", "Create failed", err.Error(), nil)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
+		meta, err := s.Store.StatBlob(r.Context(), id)
+		if err != nil {
+			writeProblem(w, rid, 500, "NC_STORE_CREATE", "Create failed", err.Error(), nil)
+			return
+		}
+		resp := map[string]any{
 			"objectId":    id,
+			"ownerToken":  token, // present as "Authorization: Bearer" to DELETE
 			"uploadUrl":   fmt.Sprintf("%s/objects/%s/blob", s.BaseURL, id),
 			"manifestUrl": fmt.Sprintf("%s/objects/%s/manifest", s.BaseURL, id),
-		})
+		}
+		if !meta.ExpiresAt.IsZero() {
+			resp["expiresAt"] = meta.ExpiresAt
+		}
+		if meta.Room != "" {
+			resp["appID"] = meta.Room
+		}
+		s.publish(EventCreated, id, meta)
+		setExpiresHeader(w, meta)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
 	default:
 		writeProblem(w, rid, 405, "NC_METHOD_NOT_ALLOWED", "Method not allowed", "", map[string]any{"allow": "POST"})
 	}
 }
 
+// createRequest is the optional JSON body of POST /objects.
+type createRequest struct {
+	MaxDownloads int       `json:"maxDownloads"` // e.g. 1 for burn-after-reading
+	ExpiresAt    time.Time `json:"expiresAt"`
+	TTL          int64     `json:"ttl"`   // seconds to live after commit, clamped by Policy.MaxTTL
+	AppID        string    `json:"appID"` // hub room to notify of lifecycle events
+}
+
+// decodeOptionalJSON decodes a small JSON body into v; an empty body is fine.
+func decodeOptionalJSON(r *http.Request, v any) error {
+	if r.Body == nil {
+		return nil
+	}
+	dec := json.NewDecoder(io.LimitReader(r.Body, 64<<10))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
 func (s *Server) handleObject(w http.ResponseWriter, r *http.Request) {
 	rid := newRID(w)
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/objects/"), "/")
@@ -52,9 +146,17 @@ func (s *Server) handleObject(w http.ResponseWriter, r *http.Request) {
 		writeProblem(w, rid, 400, "NC_BAD_REQUEST", "Missing object id", "", nil)
 		return
 	}
-	id := parts[0]
+	id, err := storage.ParseObjectID(parts[0])
+	if err != nil {
+		writeProblem(w, rid, 400, "NC_INVALID_ID", "Invalid object id", err.Error(), nil)
+		return
+	}
+	if len(parts) > 2 {
+		writeProblem(w, rid, 404, "NC_NOT_FOUND", "Unknown subresource", "", map[string]any{"sub": strings.Join(parts[1:], "/")})
+		return
+	}
 	if len(parts) == 1 {
-		writeProblem(w, rid, 400, "NC_BAD_REQUEST", "Missing subresource", "", nil)
+		s.srvObject(w, r, rid, id)
 		return
 	}
 	switch parts[1] {
@@ -64,31 +166,84 @@ func (s *Server) handleObject(w http.ResponseWriter, r *http.Request) {
 		s.srvManifest(w, r, rid, id)
 	case "commit":
 		s.srvCommit(w, r, rid, id)
+	case "progress":
+		s.srvProgress(w, r, rid, id)
 	default:
 		writeProblem(w, rid, 404, "NC_NOT_FOUND", "Unknown subresource", "", map[string]any{"sub": parts[1]})
 	}
 }
 
-func (s *Server) srvBlob(w http.ResponseWriter, r *http.Request, rid, id string) {
+// srvObject handles the object itself; only owner-authorized DELETE for now.
+func (s *Server) srvObject(w http.ResponseWriter, r *http.Request, rid string, id storage.ObjectID) {
+	if r.Method != http.MethodDelete {
+		writeProblem(w, rid, 405, "NC_METHOD_NOT_ALLOWED", "Method not allowed", "", map[string]any{"allow": "DELETE"})
+		return
+	}
+	meta, err := s.Store.StatBlob(r.Context(), id)
+	if err != nil {
+		storeProblem(w, rid, id, err, 500, "NC_STAT_FAILED", "Stat failed")
+		return
+	}
+	token := bearerToken(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeProblem(w, rid, 401, "NC_UNAUTHORIZED", "Owner token required", "", map[string]any{"objectId": id})
+		return
+	}
+	if !ownerMatches(token, meta.OwnerHash) {
+		writeProblem(w, rid, 403, "NC_FORBIDDEN", "Owner token does not match", "", map[string]any{"objectId": id})
+		return
+	}
+	if err := s.Store.Delete(r.Context(), id); err != nil {
+		storeProblem(w, rid, id, err, 500, "NC_DELETE_FAILED", "Delete failed")
+		return
+	}
+	meta.State = storage.StateDeleted
+	s.publish(EventDeleted, id, meta)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) srvBlob(w http.ResponseWriter, r *http.Request, rid string, id storage.ObjectID) {
 	switch r.Method {
 	case http.MethodPut:
-		limit := http.MaxBytesReader(w, r.Body, 1<<63-1) // rely on proxy limits
-		defer limit.Close()
-		_, etag, err := s.Store.PutBlob(r.Context(), id, limit)
+		defer r.Body.Close()
+		meta, err := s.Store.StatBlob(r.Context(), id)
 		if err != nil {
-			writeProblem(w, rid, 500, "NC_UPLOAD_FAILED", "Upload failed", err.Error(), map[string]any{"objectId": id})
+			storeProblem(w, rid, id, err, 500, "NC_STAT_FAILED", "Stat failed")
 			return
 		}
+		body := &quotaReader{s: s, r: r.Body, sub: subjectOf(meta)}
+		defer body.Close()
+		if err := body.precheck(r.ContentLength); err != nil {
+			storeProblem(w, rid, id, err, 500, "NC_UPLOAD_FAILED", "Upload failed")
+			return
+		}
+		pm := s.startUpload(id, meta, r.ContentLength)
+		n, etag, err := s.Store.PutBlob(r.Context(), id, &progressReader{r: body, m: pm})
+		if err != nil {
+			pm.done(meta, 0, false)
+			storeProblem(w, rid, id, err, 500, "NC_UPLOAD_FAILED", "Upload failed")
+			return
+		}
+		if m, err := s.Store.StatBlob(r.Context(), id); err == nil {
+			meta = m
+		}
+		pm.done(meta, n, true)
 		w.Header().Set("ETag", etag)
 		w.WriteHeader(http.StatusNoContent)
 	case http.MethodGet, http.MethodHead:
 		meta, err := s.Store.StatBlob(r.Context(), id)
 		if err != nil {
-			writeProblem(w, rid, 404, "NC_NOT_FOUND", "Object not found", err.Error(), map[string]any{"objectId": id})
+			storeProblem(w, rid, id, err, 500, "NC_STAT_FAILED", "Stat failed")
+			return
+		}
+		if meta.State.Terminal() {
+			goneProblem(w, rid, id, meta.State)
 			return
 		}
-		if !meta.Committed {
-			writeProblem(w, rid, 409, "NC_NOT_COMMITTED", "Blob not committed", "", map[string]any{"objectId": id})
+		setExpiresHeader(w, meta)
+		if meta.State != storage.StateCommitted {
+			writeProblem(w, rid, 409, "NC_NOT_COMMITTED", "Blob not committed", "", map[string]any{"objectId": id, "state": meta.State})
 			return
 		}
 		if r.Method == http.MethodHead {
@@ -98,35 +253,81 @@ func (s *Server) srvBlob(w http.ResponseWriter, r *http.Request, rid, id string)
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		f, err := s.Store.OpenFile(r.Context(), id)
+		b, err := s.Store.OpenBlob(r.Context(), id)
 		if err != nil {
-			writeProblem(w, rid, 404, "NC_NOT_FOUND", "Open failed", err.Error(), map[string]any{"objectId": id})
+			storeProblem(w, rid, id, err, 500, "NC_OPEN_FAILED", "Open failed")
 			return
 		}
-		defer f.Close()
-		stat, _ := f.Stat()
-		w.Header().Set("Content-Type", "application/octet-stream")
+		defer b.Close()
+		info := b.Info()
+		w.Header().Set("Content-Type", info.ContentType)
 		w.Header().Set("Accept-Ranges", "bytes")
-		w.Header().Set("ETag", meta.ETag)
-		http.ServeContent(w, r, "", stat.ModTime(), f) // Range + 206 handled by stdlib
+		w.Header().Set("ETag", info.ETag)
+		if meta.MaxDownloads > 0 && strings.Contains(r.Header.Get("Range"), ",") {
+			r.Header.Del("Range") // served whole rather than as an untracked multipart
+		}
+		var keys []string
+		var held bool
+		pm := s.startDownload(id, meta)
+		cw := &countingWriter{ResponseWriter: w, meter: pm, id: id, size: info.Size}
+		if meta.MaxDownloads > 0 {
+			keys = s.downloadKeys(w, r)
+			cw.admit = func(sp span) bool {
+				var ok bool
+				ok, held = s.downloads.admit(id, keys, sp, meta)
+				return ok
+			}
+		}
+		http.ServeContent(cw, r, "", info.ModTime, b) // Range + 206 handled by stdlib
+		pm.done(meta, cw.written, cw.written > 0)
+		// Unlimited objects only count responses that carried the whole blob,
+		// so nothing about their partial downloads needs remembering.
+		var complete bool
+		if meta.MaxDownloads > 0 {
+			complete = s.downloads.finish(id, keys, cw.span, cw.delivered(), info.Size, held)
+		} else {
+			complete = cw.delivered() && covers([]span{cw.span}, info.Size)
+		}
+		if complete {
+			m, err := s.Store.RecordDownload(context.WithoutCancel(r.Context()), id)
+			s.downloads.recorded(id, m, held)
+			if err == nil {
+				s.publish(EventDownloaded, id, m)
+				if m.State == storage.StateExpired {
+					s.publish(EventExpired, id, m) // download limit reached
+				}
+			}
+		}
 	default:
 		writeProblem(w, rid, 405, "NC_METHOD_NOT_ALLOWED", "Method not allowed", "", map[string]any{"allow": "PUT,GET,HEAD"})
 	}
 }
 
-func (s *Server) srvManifest(w http.ResponseWriter, r *http.Request, rid, id string) {
+func (s *Server) srvManifest(w http.ResponseWriter, r *http.Request, rid string, id storage.ObjectID) {
 	switch r.Method {
 	case http.MethodPut:
 		defer r.Body.Close()
-		if err := s.Store.PutManifest(r.Context(), id, r.Body); err != nil {
-			writeProblem(w, rid, 500, "NC_MANIFEST_WRITE", "Manifest write failed", err.Error(), map[string]any{"objectId": id})
+		b, mp := s.Manifest.readManifest(r.Body)
+		if mp != nil {
+			meta := map[string]any{"objectId": id}
+			if mp.version != "" {
+				meta["version"] = mp.version
+			}
+			if len(mp.schemaErrors) > 0 {
+				meta["errors"] = mp.schemaErrors
+			}
+			writeProblem(w, rid, mp.status, mp.code, mp.title, mp.detail, meta)
+			return
+		}
+		if err := s.Store.PutManifest(r.Context(), id, bytes.NewReader(b)); err != nil {
+			storeProblem(w, rid, id, err, 500, "NC_MANIFEST_WRITE", "Manifest write failed")
 			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 	case http.MethodGet:
 		rc, err := s.Store.GetManifest(r.Context(), id)
 		if err != nil {
-			writeProblem(w, rid, 404, "NC_NOT_FOUND", "Manifest not found", err.Error(), map[string]any{"objectId": id})
+			storeProblem(w, rid, id, err, 500, "NC_MANIFEST_READ", "Manifest read failed")
 			return
 		}
 		defer rc.Close()
@@ -139,30 +340,33 @@ func (s *Server) srvManifest(w http.ResponseWriter, r *http.Request, rid, id str
 	}
 }
 
-func (s *Server) srvCommit(w http.ResponseWriter, r *http.Request, rid, id string) {
+func (s *Server) srvCommit(w http.ResponseWriter, r *http.Request, rid string, id storage.ObjectID) {
 	if r.Method != http.MethodPost {
 		writeProblem(w, rid, 405, "NC_METHOD_NOT_ALLOWED", "Method not allowed", "", map[string]any{"allow": "POST"})
 		return
 	}
 	meta, err := s.Store.Commit(r.Context(), id)
 	if err != nil {
-		status := 500
-		var pathErr *os.PathError
-		if errors.As(err, &pathErr) {
-			status = 404
-		}
-		writeProblem(w, rid, status, "NC_COMMIT_FAILED", "Commit failed", err.Error(), map[string]any{"objectId": id})
+		storeProblem(w, rid, id, err, 500, "NC_COMMIT_FAILED", "Commit failed")
 		return
 	}
+	s.publish(EventCommitted, id, meta)
+	meta.OwnerHash = "" // never echo the credential digest
+	setExpiresHeader(w, meta)
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(meta)
 }
 
-func (s *Server) StartGC(ctx context.Context) {
-	if s.TTL <= 0 {
+// StartGC periodically expires objects and purges tombstones older than
+// Policy.TombstoneTTL. Expiry is also enforced lazily on access, so the
+// interval only bounds how long expired data lingers on disk. Objects linked
+// to hub rooms get their expiry notifications re-armed first.
+func (s *Server) StartGC(ctx context.Context, interval time.Duration) {
+	s.watchLinked()
+	if interval <= 0 {
 		return
 	}
-	t := time.NewTicker(1 * time.Hour)
+	t := time.NewTicker(interval)
 	go func() {
 		defer t.Stop()
 		for {
@@ -170,7 +374,8 @@ func (s *Server) StartGC(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			case <-t.C:
-				_ = s.Store.GC(context.Background(), s.TTL)
+				_ = s.Store.GC(context.Background(), s.Policy.TombstoneTTL)
+				s.progress.prune(time.Now().Add(-progressIdle))
 			}
 		}
 	}()
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// newOwnerToken returns a fresh bearer token and the digest the store keeps.
+// The token itself is only ever shown to the creator.
+func newOwnerToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashOwnerToken(token), nil
+}
+
+func hashOwnerToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientDigest is the per-client quota key of a client address: a digest,
+// so the store never holds addresses, of the address or, for IPv6, of its
+// /64, which a single client typically controls whole.
+func clientDigest(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	if addr.Is6() {
+		addr = netip.PrefixFrom(addr, 64).Masked().Addr()
+	}
+	sum := sha256.Sum256([]byte("client:" + addr.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken extracts the token from "Authorization: Bearer <token>".
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// ownerMatches compares the presented token with the stored digest in
+// constant time. Objects created without an owner never match.
+func ownerMatches(token, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashOwnerToken(token)), []byte(hash)) == 1
+}
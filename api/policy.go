@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+// Policy bounds object lifetimes. Zero durations disable the respective limit.
+type Policy struct {
+	UncommittedTTL time.Duration // idle time allowed between uploads and commit
+	CommittedTTL   time.Duration // lifetime after commit unless the client asks for less
+	MaxTTL         time.Duration // cap on client-requested lifetimes and expiresAt
+	TombstoneTTL   time.Duration // how long gone objects answer 410 before GC purges them
+}
+
+// createOptions applies the policy to a create request. Requested lifetimes
+// longer than MaxTTL are clamped rather than rejected.
+func (p Policy) createOptions(req createRequest, now time.Time) storage.CreateOptions {
+	committed := p.CommittedTTL
+	if req.TTL > 0 {
+		committed = time.Duration(req.TTL) * time.Second
+	}
+	if p.MaxTTL > 0 && (committed <= 0 || committed > p.MaxTTL) {
+		committed = p.MaxTTL
+	}
+	deadline := req.ExpiresAt
+	if p.MaxTTL > 0 && !deadline.IsZero() && deadline.After(now.Add(p.MaxTTL)) {
+		deadline = now.Add(p.MaxTTL)
+	}
+	return storage.CreateOptions{
+		MaxDownloads:   req.MaxDownloads,
+		ExpiresAt:      deadline,
+		UncommittedTTL: p.UncommittedTTL,
+		CommittedTTL:   committed,
+	}
+}
+
+// setExpiresHeader reports the object's current expiry, if any.
+func setExpiresHeader(w http.ResponseWriter, m storage.Meta) {
+	if !m.ExpiresAt.IsZero() {
+		w.Header().Set("X-Expires-At", m.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+}
@@ -2,9 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"os"
 
 	"github.com/google/uuid"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
 )
 
 type Problem struct {
@@ -36,3 +40,39 @@ func writeProblem(w http.ResponseWriter, rid string, status int, code, title, de
 		RID:    rid,
 	})
 }
+
+// storeProblem maps a storage error to a problem response. Errors the store
+// does not classify are reported with the caller's fallback status and code.
+func storeProblem(w http.ResponseWriter, rid string, id storage.ObjectID, err error, status int, code, title string) {
+	meta := map[string]any{"objectId": id}
+	var se *storage.StateError
+	var qe *quotaError
+	switch {
+	case errors.Is(err, storage.ErrInvalidID):
+		writeProblem(w, rid, 400, "NC_INVALID_ID", "Invalid object id", err.Error(), nil)
+	case errors.Is(err, os.ErrNotExist):
+		writeProblem(w, rid, 404, "NC_NOT_FOUND", "Object not found", "", meta) // detail would leak paths
+	case errors.As(err, &se) && se.State.Terminal():
+		goneProblem(w, rid, id, se.State)
+	case errors.As(err, &se):
+		meta["state"] = se.State
+		writeProblem(w, rid, 409, "NC_INVALID_STATE", "Operation not allowed in object state", err.Error(), meta)
+	case errors.Is(err, storage.ErrTooLarge):
+		writeProblem(w, rid, 413, "NC_TOO_LARGE", "Object too large", err.Error(), meta)
+	case errors.As(err, &qe):
+		meta["quota"] = qe.scope
+		writeProblem(w, rid, 413, "NC_QUOTA_EXCEEDED", "Quota exceeded", err.Error(), meta)
+	case errors.Is(err, storage.ErrInsufficientStorage):
+		writeProblem(w, rid, 507, "NC_INSUFFICIENT_STORAGE", "Insufficient storage", err.Error(), meta)
+	case errors.Is(err, storage.ErrManifestMissing):
+		writeProblem(w, rid, 409, "NC_MANIFEST_MISSING", "Manifest required before commit", err.Error(), meta)
+	case errors.Is(err, storage.ErrBlobIncomplete):
+		writeProblem(w, rid, 409, "NC_BLOB_INCOMPLETE", "Blob upload incomplete", err.Error(), meta)
+	default:
+		writeProblem(w, rid, status, code, title, err.Error(), meta)
+	}
+}
+
+func goneProblem(w http.ResponseWriter, rid string, id storage.ObjectID, state storage.State) {
+	writeProblem(w, rid, 410, "NC_GONE", "Object is gone", "", map[string]any{"objectId": id, "state": state})
+}
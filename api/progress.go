@@ -0,0 +1,226 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+const (
+	progressEvery = time.Second // throttles progress frames per transfer
+	progressIdle  = time.Hour   // idle entries are dropped by the GC sweep
+)
+
+// transfer counts one direction of an object's traffic.
+type transfer struct {
+	// Bytes is how much of the blob has arrived: for uploads the bytes
+	// received so far, for downloads the furthest offset any GET delivered,
+	// so a resumed download continues where it stopped.
+	Bytes     int64     `json:"bytes"`
+	Total     int64     `json:"total,omitempty"` // expected bytes, when known
+	Active    int       `json:"active"`          // requests streaming now
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
+}
+
+type objectProgress struct {
+	Upload   transfer `json:"upload"`
+	Download transfer `json:"download"`
+}
+
+// progressTracker keeps byte counts of transfers in memory; they are
+// advisory and do not survive a restart.
+type progressTracker struct {
+	mu   sync.Mutex
+	objs map[storage.ObjectID]*objectProgress
+}
+
+func (t *progressTracker) with(id storage.ObjectID, fn func(*objectProgress)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.objs[id]
+	if p == nil {
+		if t.objs == nil {
+			t.objs = make(map[storage.ObjectID]*objectProgress)
+		}
+		p = &objectProgress{}
+		t.objs[id] = p
+	}
+	fn(p)
+}
+
+func (t *progressTracker) get(id storage.ObjectID) objectProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p := t.objs[id]; p != nil {
+		return *p
+	}
+	return objectProgress{}
+}
+
+func (t *progressTracker) forget(id storage.ObjectID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.objs, id)
+}
+
+// prune drops entries without active transfers last touched before cutoff.
+func (t *progressTracker) prune(cutoff time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, p := range t.objs {
+		idle := func(x transfer) bool { return x.Active == 0 && x.UpdatedAt.Before(cutoff) }
+		if idle(p.Upload) && idle(p.Download) {
+			delete(t.objs, id)
+		}
+	}
+}
+
+// progressMeter reports one request's transfer: every position goes to
+// the tracker, and a progress frame at most every progressEvery.
+type progressMeter struct {
+	s        *Server
+	id       storage.ObjectID
+	meta     storage.Meta
+	download bool
+	last     time.Time
+	sent     int64 // Bytes of the last frame
+}
+
+func (s *Server) startUpload(id storage.ObjectID, meta storage.Meta, total int64) *progressMeter {
+	s.progress.with(id, func(p *objectProgress) {
+		p.Upload = transfer{Total: max(total, 0), Active: 1, UpdatedAt: time.Now()}
+	})
+	meta.State = storage.StateUploading
+	return &progressMeter{s: s, id: id, meta: meta}
+}
+
+func (s *Server) startDownload(id storage.ObjectID, meta storage.Meta) *progressMeter {
+	s.progress.with(id, func(p *objectProgress) {
+		p.Download.Active++
+		p.Download.Total = meta.Size
+		p.Download.UpdatedAt = time.Now()
+	})
+	return &progressMeter{s: s, id: id, meta: meta, download: true}
+}
+
+func (m *progressMeter) transfer(p *objectProgress) *transfer {
+	if m.download {
+		return &p.Download
+	}
+	return &p.Upload
+}
+
+// report records that the transfer reached pos.
+func (m *progressMeter) report(pos int64) {
+	var snap transfer
+	now := time.Now()
+	m.s.progress.with(m.id, func(p *objectProgress) {
+		t := m.transfer(p)
+		if !m.download || pos > t.Bytes {
+			t.Bytes = pos
+		}
+		t.UpdatedAt = now
+		snap = *t
+	})
+	if now.Sub(m.last) >= progressEvery {
+		m.last = now
+		m.send(snap)
+	}
+}
+
+// done ends the request's transfer. A finished upload reports its final
+// size; a failed one resets the count along with the object.
+func (m *progressMeter) done(meta storage.Meta, n int64, ok bool) {
+	var snap transfer
+	m.s.progress.with(m.id, func(p *objectProgress) {
+		t := m.transfer(p)
+		t.Active = max(t.Active-1, 0)
+		if !m.download {
+			t.Bytes, t.Total = 0, 0
+			if ok {
+				t.Bytes, t.Total = n, n
+			}
+		}
+		t.UpdatedAt = time.Now()
+		snap = *t
+	})
+	if ok && !(m.download && snap.Bytes == m.sent) {
+		m.meta = meta
+		m.send(snap)
+	}
+}
+
+func (m *progressMeter) send(t transfer) {
+	m.sent = t.Bytes
+	dir := "upload"
+	if m.download {
+		dir = "download"
+	}
+	m.s.publishEvent(m.id, m.meta, ObjectEvent{Event: EventProgress, Direction: dir, Bytes: t.Bytes, Total: t.Total})
+}
+
+// progressReader feeds an upload's byte count to its meter.
+type progressReader struct {
+	r    io.Reader
+	m    *progressMeter
+	read int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.m.report(p.read)
+	}
+	return n, err
+}
+
+// srvProgress reports the transfer byte counts of an object.
+func (s *Server) srvProgress(w http.ResponseWriter, r *http.Request, rid string, id storage.ObjectID) {
+	if r.Method != http.MethodGet {
+		writeProblem(w, rid, 405, "NC_METHOD_NOT_ALLOWED", "Method not allowed", "", map[string]any{"allow": "GET"})
+		return
+	}
+	meta, err := s.Store.StatBlob(r.Context(), id)
+	if err != nil {
+		storeProblem(w, rid, id, err, 500, "NC_STAT_FAILED", "Stat failed")
+		return
+	}
+	if meta.State.Terminal() {
+		goneProblem(w, rid, id, meta.State)
+		return
+	}
+	p := s.progress.get(id)
+	if meta.State == storage.StateUploaded || meta.State == storage.StateCommitted {
+		// The store is authoritative once the blob is in; counts may be
+		// gone after a restart.
+		p.Upload.Bytes, p.Upload.Total = meta.Size, meta.Size
+	}
+	if meta.State == storage.StateCommitted {
+		p.Download.Total = meta.Size
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"objectId":  id,
+		"state":     meta.State,
+		"size":      meta.Size,
+		"downloads": meta.Downloads,
+		"upload":    p.Upload,
+		"download":  p.Download,
+	})
+}
+
+// rangeStart returns the first body offset of a 206 response.
+func rangeStart(h http.Header) int64 {
+	var start int64
+	if _, err := fmt.Sscanf(h.Get("Content-Range"), "bytes %d-", &start); err != nil {
+		return 0
+	}
+	return start
+}
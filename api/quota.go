@@ -0,0 +1,273 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+// Quota bounds what clients may store. Zero fields are unlimited. All but the
+// object size cap count committed and staged blobs plus uploads in flight,
+// and need a store implementing storage.Accountant; others only get the cap.
+//
+// Owner tokens are free to mint, since creating without one returns a fresh
+// one, so the per-client limit, counted by the address objects were created
+// from, is what holds a single client back. Unset, it defaults to the owner
+// limit.
+type Quota struct {
+	MaxObjectBytes int64 // largest single blob
+	MaxOwnerBytes  int64 // live bytes per owner token
+	MaxRoomBytes   int64 // live bytes of the objects linked to one hub room
+	MaxClientBytes int64 // live bytes created from one client address (an IPv6 /64)
+	MaxTotalBytes  int64 // high-watermark for the whole store; creates and uploads are refused above it
+}
+
+// clientLimit is MaxClientBytes, or MaxOwnerBytes when unset.
+func (q Quota) clientLimit() int64 {
+	if q.MaxClientBytes > 0 {
+		return q.MaxClientBytes
+	}
+	return q.MaxOwnerBytes
+}
+
+// quotaError names the per-owner, per-room or per-client limit an upload
+// ran into.
+type quotaError struct{ scope string }
+
+func (e *quotaError) Error() string { return e.scope + " quota exceeded" }
+
+var errFull = fmt.Errorf("store high-watermark reached: %w", storage.ErrInsufficientStorage)
+
+// quotaSubject is who an upload's bytes count against: the owner, room and
+// client recorded in the object's meta.
+type quotaSubject struct {
+	owner, room, client string
+}
+
+func subjectOf(m storage.Meta) quotaSubject {
+	return quotaSubject{owner: m.OwnerHash, room: m.Room, client: m.Client}
+}
+
+// quotaChunk is how many bytes an upload reserves at a time, so the store's
+// usage is consulted once per chunk rather than per read.
+const quotaChunk = 1 << 20
+
+// inflight tracks bytes reserved by uploads that are still streaming; the
+// store only counts a blob once its upload has finished.
+type inflight struct {
+	mu     sync.Mutex
+	owner  map[string]int64
+	room   map[string]int64
+	client map[string]int64
+	total  int64
+}
+
+// reserve grants between need and quotaChunk more bytes to an upload for
+// sub, or fails if even need would break a limit.
+func (s *Server) reserve(sub quotaSubject, need int64) (int64, error) {
+	q := s.Quota
+	clientLimit := q.clientLimit()
+	var ou, tu, ru, cu storage.Usage
+	acct, ok := s.Store.(storage.Accountant)
+	if ok && (q.MaxOwnerBytes > 0 || q.MaxTotalBytes > 0 || q.MaxRoomBytes > 0 || clientLimit > 0) {
+		var err error
+		ou, tu, err = acct.Usage(sub.owner)
+		if err == nil {
+			ru, cu, err = acct.GroupUsage(sub.room, sub.client)
+		}
+		if errors.Is(err, errors.ErrUnsupported) {
+			ok = false // a wrapper over a store without accounting
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	if !ok {
+		q, clientLimit = Quota{}, 0
+	}
+	f := &s.inflight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	grant := max(need, quotaChunk)
+	limits := []struct {
+		key         string // "" when the object has no owner, room or client
+		limit, used int64
+		err         error
+	}{
+		{sub.owner, q.MaxOwnerBytes, ou.Bytes + f.owner[sub.owner], &quotaError{"owner"}},
+		{sub.room, q.MaxRoomBytes, ru.Bytes + f.room[sub.room], &quotaError{"room"}},
+		{sub.client, clientLimit, cu.Bytes + f.client[sub.client], &quotaError{"client"}},
+		{"-", q.MaxTotalBytes, tu.Bytes + f.total, errFull},
+	}
+	for _, l := range limits {
+		if l.key == "" || l.limit <= 0 {
+			continue
+		}
+		left := l.limit - l.used
+		if left < need {
+			return 0, l.err
+		}
+		grant = min(grant, left)
+	}
+	if f.owner == nil {
+		f.owner = make(map[string]int64)
+		f.room = make(map[string]int64)
+		f.client = make(map[string]int64)
+	}
+	addInflight(f.owner, sub.owner, grant)
+	addInflight(f.room, sub.room, grant)
+	addInflight(f.client, sub.client, grant)
+	f.total += grant
+	return grant, nil
+}
+
+func (s *Server) release(sub quotaSubject, n int64) {
+	if n == 0 {
+		return
+	}
+	f := &s.inflight
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addInflight(f.owner, sub.owner, -n)
+	addInflight(f.room, sub.room, -n)
+	addInflight(f.client, sub.client, -n)
+	f.total -= n
+}
+
+// addInflight adds n to the bytes in flight for key, dropping it at zero.
+// Objects without an owner, room or client share no limit, so "" is skipped.
+func addInflight(m map[string]int64, key string, n int64) {
+	if key == "" {
+		return
+	}
+	if m[key] += n; m[key] <= 0 {
+		delete(m, key)
+	}
+}
+
+// full reports whether the store is at its high-watermark.
+func (s *Server) full() bool {
+	acct, ok := s.Store.(storage.Accountant)
+	if !ok || s.Quota.MaxTotalBytes <= 0 {
+		return false
+	}
+	_, tu, err := acct.Usage("")
+	if err != nil {
+		return false
+	}
+	s.inflight.mu.Lock()
+	defer s.inflight.mu.Unlock()
+	return tu.Bytes+s.inflight.total >= s.Quota.MaxTotalBytes
+}
+
+// quotaReader enforces the quota while a blob streams through it. Bytes are
+// reserved ahead of the reads and handed back by Close. The first reservation
+// waits for the first Read, when the store has released the staged blob a
+// re-upload replaces.
+type quotaReader struct {
+	s        *Server
+	r        io.Reader
+	sub      quotaSubject
+	declared int64 // Content-Length, reserved whole up front; <= 0 if unknown
+	read     int64
+	reserved int64
+	started  bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if !q.started {
+		q.started = true
+		if q.declared > 0 {
+			g, err := q.s.reserve(q.sub, q.declared)
+			if err != nil {
+				return 0, err
+			}
+			q.reserved += g
+		}
+	}
+	n, err := q.r.Read(p)
+	q.read += int64(n)
+	if limit := q.s.Quota.MaxObjectBytes; limit > 0 && q.read > limit {
+		return n, fmt.Errorf("blob exceeds %d bytes: %w", limit, storage.ErrTooLarge)
+	}
+	if q.read > q.reserved {
+		g, rerr := q.s.reserve(q.sub, q.read-q.reserved)
+		if rerr != nil {
+			return n, rerr
+		}
+		q.reserved += g
+	}
+	return n, err
+}
+
+// precheck refuses a declared Content-Length over the size cap before the
+// upload starts; the first Read reserves it.
+func (q *quotaReader) precheck(n int64) error {
+	if limit := q.s.Quota.MaxObjectBytes; limit > 0 && n > limit {
+		return fmt.Errorf("blob of %d bytes exceeds %d: %w", n, limit, storage.ErrTooLarge)
+	}
+	q.declared = n
+	return nil
+}
+
+func (q *quotaReader) Close() error {
+	q.s.release(q.sub, q.reserved)
+	q.reserved = 0
+	return nil
+}
+
+// srvUsage reports usage and limits: the store as a whole, plus the caller's
+// own objects when an owner token is presented.
+func (s *Server) srvUsage(w http.ResponseWriter, r *http.Request) {
+	rid := newRID(w)
+	if r.Method != http.MethodGet {
+		writeProblem(w, rid, 405, "NC_METHOD_NOT_ALLOWED", "Method not allowed", "", map[string]any{"allow": "GET"})
+		return
+	}
+	acct, ok := s.Store.(storage.Accountant)
+	if !ok {
+		writeProblem(w, rid, 501, "NC_NOT_IMPLEMENTED", "Usage not tracked by this store", "", nil)
+		return
+	}
+	var hash string
+	if token := bearerToken(r); token != "" {
+		hash = hashOwnerToken(token)
+	}
+	ou, tu, err := acct.Usage(hash)
+	if errors.Is(err, errors.ErrUnsupported) {
+		writeProblem(w, rid, 501, "NC_NOT_IMPLEMENTED", "Usage not tracked by this store", "", nil)
+		return
+	}
+	if err != nil {
+		writeProblem(w, rid, 500, "NC_USAGE_FAILED", "Usage lookup failed", err.Error(), nil)
+		return
+	}
+	resp := map[string]any{
+		"total": usageJSON(tu, s.Quota.MaxTotalBytes),
+		"limits": map[string]int64{
+			"maxObjectBytes": s.Quota.MaxObjectBytes,
+			"maxOwnerBytes":  s.Quota.MaxOwnerBytes,
+			"maxRoomBytes":   s.Quota.MaxRoomBytes,
+			"maxClientBytes": s.Quota.clientLimit(),
+			"maxTotalBytes":  s.Quota.MaxTotalBytes,
+		},
+	}
+	if hash != "" {
+		resp["owner"] = usageJSON(ou, s.Quota.MaxOwnerBytes)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func usageJSON(u storage.Usage, limit int64) map[string]any {
+	m := map[string]any{"objects": u.Objects, "bytes": u.Bytes}
+	if limit > 0 {
+		m["remainingBytes"] = max(limit-u.Bytes, 0)
+	}
+	return m
+}
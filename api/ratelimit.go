@@ -0,0 +1,28 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/collapsinghierarchy/noisytransfer/ratelimit"
+)
+
+// RateLimit bounds how fast a single client may call the API. The zero value
+// allows everything.
+type RateLimit struct {
+	PerIP   *ratelimit.Limiter // requests per client IP
+	Proxies ratelimit.Proxies  // trusted to report the client IP in X-Forwarded-For
+}
+
+// limited wraps an endpoint with the per-IP limit.
+func (s *Server) limited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := s.RateLimit.Proxies.ClientIP(r)
+		if ok, wait := s.RateLimit.PerIP.Allow(ip); !ok {
+			w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+			writeProblem(w, newRID(w), 429, "NC_RATE_LIMITED", "Too many requests", "",
+				map[string]any{"retryAfterMs": max(wait.Milliseconds(), 1)})
+			return
+		}
+		next(w, r)
+	}
+}
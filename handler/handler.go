@@ -1,8 +1,10 @@
 package handler
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/collapsinghierarchy/noisytransfer/hub"
+	"github.com/collapsinghierarchy/noisytransfer/ratelimit"
 )
 
 const (
@@ -26,10 +29,11 @@ type helloMsg struct {
 	DeliveredUpTo uint64 `json:"deliveredUpTo"`
 }
 
+// sendMsg also carries "payload", which is taken still encoded (see
+// hub.Codec.Fields) so it reaches the mailbox untouched.
 type sendMsg struct {
-	Type    string          `json:"type"` // "send"
-	To      string          `json:"to"`   // "A"|"B"
-	Payload json.RawMessage `json:"payload"`
+	Type string `json:"type"` // "send"
+	To   string `json:"to"`   // "A"|"B"
 }
 
 type deliveredMsg struct {
@@ -42,6 +46,7 @@ func NewWSHandler(
 	allowedOrigins []string,
 	lg *slog.Logger,
 	dev bool,
+	opts Options,
 ) http.Handler {
 	allow := make(map[string]struct{}, len(allowedOrigins))
 	for _, o := range allowedOrigins {
@@ -60,22 +65,28 @@ func NewWSHandler(
 		// Reasonable buffer sizes for larger frames
 		ReadBufferSize:  64 << 10,
 		WriteBufferSize: 64 << 10,
+		Subprotocols:    wireSubprotocols,
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		appID := r.URL.Query().Get("appID")
-		if _, err := uuid.Parse(appID); err != nil {
-			http.Error(w, "invalid appID", http.StatusBadRequest)
+		appID, side, err := checkRoom(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		side := r.URL.Query().Get("side")
-		if side != "A" && side != "B" {
-			http.Error(w, "invalid side (want A or B)", http.StatusBadRequest)
+		sessionID := r.URL.Query().Get("sid") // optional; client may pass empty
+
+		ip := opts.Proxies.ClientIP(r)
+		if ok, wait := opts.IPLimit.Allow(ip); !ok {
+			tooMany(w, wait)
 			return
 		}
 
-		sessionID := r.URL.Query().Get("sid") // optional; client may pass empty
+		if offersOnlyUnknown(websocket.Subprotocols(r)) {
+			http.Error(w, "unsupported protocol; want one of "+strings.Join(wireSubprotocols, ", "), http.StatusBadRequest)
+			return
+		}
 
 		conn, err := up.Upgrade(w, r, nil)
 		if err != nil {
@@ -92,7 +103,19 @@ func NewWSHandler(
 		})
 
 		// Register A/B mailbox connection in the Hub.
-		if err := h.Register(appID, side, sessionID, conn); err != nil {
+		proto := parseSubprotocol(conn.Subprotocol())
+		conn.SetReadLimit(opts.readLimit(proto.version))
+		handle := frameHandlers[proto.version]
+		codec := proto.codec
+		hc := hub.NewWSConn(conn, codec)
+		fc := &frameConn{h: h, conn: hc, proto: proto, appID: appID, side: side, sessionID: sessionID}
+		if proto.version >= 2 {
+			// Before Register, which may already push pending deliveries.
+			if err := fc.reply(welcome(proto, opts)); err != nil {
+				return
+			}
+		}
+		if err := h.Register(appID, side, sessionID, hc); err != nil {
 			lg.Warn("hub register failed", "err", err, "appID", appID, "side", side)
 			_ = conn.WriteMessage(
 				websocket.CloseMessage,
@@ -100,20 +123,15 @@ func NewWSHandler(
 			)
 			return
 		}
-		defer h.Unregister(appID, conn)
-
-		// If both sides are present, tell both (compat signal for your tests/UI)
-		if h.RoomSize(appID) == 2 {
-			lg.Info("Room full - broadcasting", "sys", "ws", "appID", appID)
-			h.BroadcastEvent(appID, map[string]any{"type": "room_full"})
-		}
+		defer h.Unregister(appID, hc)
+		announceRoomFull(h, appID, lg)
 
 		go func() {
 			ticker := time.NewTicker(pingPeriod)
 			defer ticker.Stop()
 			for range ticker.C {
 				// Mailbox (A/B) → ping via hub (exact-connection check).
-				if err := h.WritePingConn(appID, conn, writeWait); err != nil {
+				if err := h.WritePingConn(appID, hc, writeWait); err != nil {
 					_ = conn.Close()
 					return
 				}
@@ -121,6 +139,8 @@ func NewWSHandler(
 		}()
 
 		// Process messages
+		bucket := ratelimit.NewBucket(opts.ConnRate)
+		var quietUntil time.Time // no rate_limited frames before then
 		for {
 			mt, msg, err := conn.ReadMessage()
 			if err != nil {
@@ -134,45 +154,110 @@ func NewWSHandler(
 			var peek struct {
 				Type string `json:"type"`
 			}
-			if err := json.Unmarshal(msg, &peek); err != nil {
-				lg.Warn("bad json", "err", err)
+			if err := codec.Unmarshal(msg, &peek); err != nil {
+				lg.Warn("bad frame", "codec", codec.Name(), "err", err)
 				continue
 			}
+			ok, wait := bucket.Allow()
+			if ok {
+				ok, wait = opts.allowFrame(appID, ip)
+			}
+			if !ok {
+				// One notice per wait, so a flood is not answered by a flood.
+				if now := time.Now(); now.After(quietUntil) {
+					quietUntil = now.Add(wait)
+					lg.Info("rate limited", "appID", appID, "side", side, "ip", ip, "type", peek.Type)
+					_ = fc.reply(rateLimitedMsg{Type: "rate_limited", Ref: peek.Type, RetryAfterMs: max(wait.Milliseconds(), 1)})
+				}
+				continue
+			}
+			if err := handle(fc, peek.Type, msg); errors.Is(err, errUnknownFrame) {
+				lg.Info("Ignoring unknown frame", "type", peek.Type)
+			} else if err != nil {
+				lg.Warn("frame rejected", "type", peek.Type, "err", err)
+			}
+		}
+	})
+}
 
-			// non-cache lane: mailbox + webrtc signaling
-			switch strings.ToLower(peek.Type) {
-			case "offer", "answer", "ice":
-				h.Broadcast(appID, conn, msg)
+// errUnknownFrame is returned by dispatch for frame types it does not handle.
+var errUnknownFrame = errors.New("unknown frame type")
 
-			case "hello":
-				var m helloMsg
-				if err := json.Unmarshal(msg, &m); err != nil {
-					lg.Warn("hello unmarshal", "err", err)
-					continue
-				}
-				h.Hello(appID, side, sessionID, m.DeliveredUpTo)
+// dispatch applies one client frame, encoded with codec, for side of room
+// appID.
+func dispatch(h *hub.Hub, appID, side, sessionID string, codec hub.Codec, typ string, msg []byte) error {
+	// non-cache lane: mailbox + webrtc signaling
+	switch strings.ToLower(typ) {
+	case "offer", "answer", "ice":
+		if err := h.Signal(appID, side, hub.Payload{Codec: codec, Data: msg}); err != nil {
+			return fmt.Errorf("%s: %w", strings.ToLower(typ), err)
+		}
 
-			case "send":
-				var m sendMsg
-				if err := json.Unmarshal(msg, &m); err != nil {
-					lg.Warn("send unmarshal", "err", err)
-					continue
-				}
-				if err := h.Enqueue(appID, side, m.To, m.Payload); err != nil {
-					lg.Warn("send enqueue failed", "err", err)
-				}
+	case "hello":
+		var m helloMsg
+		if err := codec.Unmarshal(msg, &m); err != nil {
+			return fmt.Errorf("hello unmarshal: %w", err)
+		}
+		h.Hello(appID, side, sessionID, m.DeliveredUpTo)
 
-			case "delivered":
-				var m deliveredMsg
-				if err := json.Unmarshal(msg, &m); err != nil {
-					lg.Warn("delivered unmarshal", "err", err)
-					continue
-				}
-				h.AckUpTo(appID, side, m.UpTo)
+	case "send":
+		var m sendMsg
+		if err := codec.Unmarshal(msg, &m); err != nil {
+			return fmt.Errorf("send unmarshal: %w", err)
+		}
+		fields, err := codec.Fields(msg)
+		if err != nil {
+			return fmt.Errorf("send unmarshal: %w", err)
+		}
+		payload := hub.Payload{Codec: codec, Data: fields["payload"]}
+		if _, err := h.Enqueue(appID, side, m.To, payload); err != nil {
+			return fmt.Errorf("send enqueue: %w", err)
+		}
 
-			default:
-				lg.Info("Ignoring unknown frame", "type", peek.Type)
-			}
+	case "delivered":
+		var m deliveredMsg
+		if err := codec.Unmarshal(msg, &m); err != nil {
+			return fmt.Errorf("delivered unmarshal: %w", err)
 		}
-	})
+		h.AckUpTo(appID, side, m.UpTo)
+
+	default:
+		return errUnknownFrame
+	}
+	return nil
+}
+
+// announceRoomFull tells both sides once the second one has arrived
+// (compat signal for your tests/UI).
+func announceRoomFull(h *hub.Hub, appID string, lg *slog.Logger) {
+	if h.RoomSize(appID) == 2 {
+		lg.Info("Room full - broadcasting", "appID", appID)
+		h.BroadcastEvent(appID, map[string]any{"type": "room_full"})
+	}
+}
+
+// checkRoom validates the appID and side query parameters shared by the
+// WebSocket and SSE endpoints.
+func checkRoom(q url.Values) (appID, side string, err error) {
+	appID = q.Get("appID")
+	if _, err := uuid.Parse(appID); err != nil {
+		return "", "", errors.New("invalid appID")
+	}
+	side = q.Get("side")
+	if side != "A" && side != "B" {
+		return "", "", errors.New("invalid side (want A or B)")
+	}
+	return appID, side, nil
+}
+
+// originOK admits HTTP (non-WebSocket) requests from allowed origins and
+// those without an Origin: EventSource sends none on same-origin requests,
+// and neither do server-side clients.
+func originOK(r *http.Request, allow map[string]struct{}, dev bool) bool {
+	origin := r.Header.Get("Origin")
+	if dev || origin == "" {
+		return true
+	}
+	_, ok := allow[origin]
+	return ok
 }
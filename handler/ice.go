@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/hub"
+	"github.com/collapsinghierarchy/noisytransfer/turn"
+)
+
+// DefaultCredentialTTL is how long issued TURN credentials stay valid when
+// ICEConfig.TTL is zero.
+const DefaultCredentialTTL = 12 * time.Hour
+
+// ICEConfig is what /ice-servers hands out.
+type ICEConfig struct {
+	STUN    []string      // e.g. "stun:turn.example.com:3478"
+	TURN    []string      // e.g. "turn:turn.example.com:3478?transport=udp"
+	Secrets *turn.Secrets // signs the TURN credentials
+	TTL     time.Duration // credential lifetime; 0 = DefaultCredentialTTL
+}
+
+// iceServer is an RTCIceServer as RTCPeerConnection takes it.
+type iceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// NewICEServersHandler serves GET /ice-servers?appID=&side=: the STUN and
+// TURN servers for RTCPeerConnection's iceServers, with freshly issued
+// time-limited TURN credentials for that side of the room (see
+// turn.Secrets). The side must be connected to the room over /ws or /sse;
+// its credentials are revoked when the hub forgets the room, and the TURN
+// server refuses them while the room is not live (see hub.Hub.RoomLive).
+func NewICEServersHandler(
+	h *hub.Hub,
+	cfg ICEConfig,
+	allowedOrigins []string,
+	lg *slog.Logger,
+	dev bool,
+	opts Options,
+) http.Handler {
+	allow := make(map[string]struct{}, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		allow[o] = struct{}{}
+	}
+	ttl := cfg.TTL
+	if ttl <= 0 {
+		ttl = DefaultCredentialTTL
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !originOK(r, allow, dev) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		appID, side, err := checkRoom(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, wait := opts.IPLimit.Allow(opts.Proxies.ClientIP(r)); !ok {
+			tooMany(w, wait)
+			return
+		}
+		if !h.Connected(appID, side) {
+			http.Error(w, "side not connected; join the room first", http.StatusNotFound)
+			return
+		}
+
+		resp := map[string]any{"ttl": int64(ttl.Seconds())}
+		servers := []iceServer{}
+		if len(cfg.STUN) > 0 {
+			servers = append(servers, iceServer{URLs: cfg.STUN})
+		}
+		if len(cfg.TURN) > 0 && cfg.Secrets != nil {
+			c := cfg.Secrets.Issue(appID, side, ttl)
+			servers = append(servers, iceServer{URLs: cfg.TURN, Username: c.Username, Credential: c.Password})
+			resp["expiresAt"] = c.Expires
+			lg.Debug("issued TURN credential", "username", c.Username)
+		}
+		resp["iceServers"] = servers
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/collapsinghierarchy/noisytransfer/hub"
+	"github.com/collapsinghierarchy/noisytransfer/ratelimit"
+)
+
+// DefaultMaxFrame bounds a client frame when Options.MaxFrameBytes is zero.
+const DefaultMaxFrame = 1 << 20
+
+// Options tunes the mailbox endpoints; the zero value is usable.
+type Options struct {
+	// MaxFrameBytes is the largest frame accepted from a client; 0 means
+	// DefaultMaxFrame on version 2 connections and no limit on version 1
+	// ones, which predate it.
+	MaxFrameBytes int64
+	Features      []string // advertised in the welcome frame next to the built-in ones
+
+	// Rate limits on client frames; the zero values allow everything. The
+	// limiters are shared by /ws, /sse and /rooms so a client cannot dodge
+	// them by switching transports. Over the limit, frames are dropped:
+	// WebSocket clients get a rate_limited frame, HTTP ones a 429.
+	ConnRate  ratelimit.Rate     // per WebSocket connection
+	RoomLimit *ratelimit.Limiter // per room
+	IPLimit   *ratelimit.Limiter // per client IP, also charged for HTTP requests and upgrades
+	Proxies   ratelimit.Proxies  // trusted to report the client IP in X-Forwarded-For
+}
+
+func (o Options) maxFrame() int64 {
+	if o.MaxFrameBytes > 0 {
+		return o.MaxFrameBytes
+	}
+	return DefaultMaxFrame
+}
+
+// readLimit is the frame limit of a connection speaking version; 0 is none.
+// Version 1 clients are only held to a limit the operator set explicitly.
+func (o Options) readLimit(version int) int64 {
+	if version < 2 {
+		return o.MaxFrameBytes
+	}
+	return o.maxFrame()
+}
+
+// Subprotocols are "noisytransfer.v<version>[+<encoding>]", e.g.
+// "noisytransfer.v2+cbor"; the encoding defaults to JSON. The names from
+// before versioning ("noisytransfer.cbor") and no subprotocol at all mean
+// version 1. Listed in order of preference.
+var wireSubprotocols = []string{
+	subprotocolPrefix + "v2+cbor",
+	subprotocolPrefix + "v2+msgpack",
+	subprotocolPrefix + "v2",
+	subprotocolPrefix + "v1+cbor",
+	subprotocolPrefix + "v1+msgpack",
+	subprotocolPrefix + "v1",
+	subprotocolPrefix + "cbor",
+	subprotocolPrefix + "msgpack",
+	subprotocolPrefix + "json",
+}
+
+const subprotocolPrefix = "noisytransfer."
+
+// protocol is what a connection negotiated.
+type protocol struct {
+	name    string // the subprotocol, "" if none
+	version int
+	codec   hub.Codec
+}
+
+// parseSubprotocol interprets a negotiated (hence listed) subprotocol.
+func parseSubprotocol(name string) protocol {
+	p := protocol{name: name, version: 1, codec: hub.JSON}
+	rest, ok := strings.CutPrefix(name, subprotocolPrefix)
+	if !ok {
+		return p
+	}
+	ver, enc, _ := strings.Cut(rest, "+")
+	if v, ok := strings.CutPrefix(ver, "v"); ok {
+		p.version, _ = strconv.Atoi(v)
+	} else {
+		enc = ver // pre-versioning name
+	}
+	if c, ok := hub.CodecByName(enc); ok {
+		p.codec = c
+	}
+	return p
+}
+
+// offersOnlyUnknown reports whether a client asked exclusively for
+// noisytransfer subprotocols this server does not speak, e.g. a future
+// version; such clients are refused rather than silently downgraded.
+func offersOnlyUnknown(offered []string) bool {
+	ours := false
+	for _, o := range offered {
+		for _, s := range wireSubprotocols {
+			if o == s {
+				return false
+			}
+		}
+		ours = ours || strings.HasPrefix(o, subprotocolPrefix)
+	}
+	return ours
+}
+
+// frameConn is what a version's frame handler works with.
+type frameConn struct {
+	h                      *hub.Hub
+	conn                   hub.Conn
+	proto                  protocol
+	appID, side, sessionID string
+}
+
+// reply writes a frame back on the connection itself.
+func (fc *frameConn) reply(v any) error {
+	msg, err := fc.proto.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fc.conn.WriteMessage(msg, writeWait)
+}
+
+// A frameHandler applies one client frame of the given type. Each protocol
+// version has its own, so the vocabulary can change without breaking
+// clients of earlier versions.
+type frameHandler func(fc *frameConn, typ string, msg []byte) error
+
+var frameHandlers = map[int]frameHandler{
+	1: handleV1,
+	2: handleV2,
+}
+
+// supportedVersions is advertised in the welcome frame.
+var supportedVersions = []int{1, 2}
+
+// handleV1 is the original vocabulary: rejected frames are only logged, and
+// signaling is relayed unchecked to the other side if it is connected.
+func handleV1(fc *frameConn, typ string, msg []byte) error {
+	switch strings.ToLower(typ) {
+	case "offer", "answer", "ice":
+		fc.h.Broadcast(fc.appID, fc.conn, msg)
+		return nil
+	}
+	return dispatch(fc.h, fc.appID, fc.side, fc.sessionID, fc.proto.codec, typ, msg)
+}
+
+// handleV2 adds an application-level ping, checks and tracks signaling (see
+// hub.Signal) and answers rejected frames with an error frame.
+func handleV2(fc *frameConn, typ string, msg []byte) error {
+	if strings.EqualFold(typ, "ping") {
+		return fc.reply(map[string]any{"type": "pong"})
+	}
+	err := dispatch(fc.h, fc.appID, fc.side, fc.sessionID, fc.proto.codec, typ, msg)
+	if err != nil {
+		code := "bad_frame"
+		switch {
+		case errors.Is(err, errUnknownFrame):
+			code = "unknown_frame"
+		case errors.Is(err, hub.ErrBacklog):
+			code = "backlog"
+		case errors.Is(err, hub.ErrInvalidSide):
+			code = "invalid_side"
+		case errors.Is(err, hub.ErrBadSignal):
+			code = "bad_signal"
+		case errors.Is(err, hub.ErrSignalState):
+			code = "signal_state"
+		}
+		_ = fc.reply(errorMsg{Type: "error", Code: code, Ref: typ, Message: err.Error()})
+	}
+	return err
+}
+
+type errorMsg struct {
+	Type    string `json:"type"` // "error"
+	Code    string `json:"code"`
+	Ref     string `json:"ref,omitempty"` // type of the offending frame
+	Message string `json:"message,omitempty"`
+}
+
+type welcomeMsg struct {
+	Type     string        `json:"type"` // "welcome"
+	Protocol string        `json:"protocol"`
+	Version  int           `json:"version"`
+	Versions []int         `json:"versions"` // all the server speaks
+	Encoding string        `json:"encoding"`
+	Limits   welcomeLimits `json:"limits"`
+	Features []string      `json:"features"`
+}
+
+type welcomeLimits struct {
+	MaxFrameBytes int64 `json:"maxFrameBytes"`
+	MailboxCap    int   `json:"mailboxCap"`
+	PingInterval  int64 `json:"pingIntervalMs"`
+	// Frames per second and burst allowed on the connection, when limited.
+	FramesPerSec float64 `json:"framesPerSec,omitempty"`
+	FrameBurst   int     `json:"frameBurst,omitempty"`
+}
+
+// welcome is sent first on version 2 connections.
+func welcome(p protocol, opts Options) welcomeMsg {
+	features := append([]string{"mailbox", "signaling", "ping", "errors", "undeliverable"}, opts.Features...)
+	return welcomeMsg{
+		Type:     "welcome",
+		Protocol: p.name,
+		Version:  p.version,
+		Versions: supportedVersions,
+		Encoding: p.codec.Name(),
+		Limits: welcomeLimits{
+			MaxFrameBytes: opts.maxFrame(),
+			MailboxCap:    hub.MaxMailboxQueued,
+			PingInterval:  pingPeriod.Milliseconds(),
+			FramesPerSec:  opts.ConnRate.PerSec,
+			FrameBurst:    opts.ConnRate.Burst,
+		},
+		Features: features,
+	}
+}
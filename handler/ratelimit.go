@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/ratelimit"
+)
+
+// allowFrame charges one frame to the client's IP and to the room.
+func (o Options) allowFrame(appID, ip string) (bool, time.Duration) {
+	if ok, wait := o.IPLimit.Allow(ip); !ok {
+		return false, wait
+	}
+	return o.RoomLimit.Allow(appID)
+}
+
+// tooMany answers an HTTP request over its rate limit.
+func tooMany(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+	http.Error(w, "rate limited", http.StatusTooManyRequests)
+}
+
+type rateLimitedMsg struct {
+	Type         string `json:"type"`          // "rate_limited"
+	Ref          string `json:"ref,omitempty"` // type of the dropped frame
+	RetryAfterMs int64  `json:"retryAfterMs"`
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/hub"
+)
+
+const (
+	defaultPollWait = 30 * time.Second
+	maxPollWait     = 50 * time.Second // stays under the server's WriteTimeout
+)
+
+type postMessage struct {
+	To      string          `json:"to"` // defaults to the other side
+	Payload json.RawMessage `json:"payload"`
+}
+
+type ackMsg struct {
+	UpTo uint64 `json:"upTo"`
+}
+
+// NewRESTHandler exposes the mailbox without a persistent connection, for
+// server-to-server use. Mount it at "/rooms/".
+//
+//	POST /rooms/{appID}/{side}/messages        enqueue {"to","payload"} from side
+//	GET  /rooms/{appID}/{side}/messages        long-poll side's deliveries
+//	     ?after=<seq>&wait=<duration>
+//	POST /rooms/{appID}/{side}/messages/ack    {"upTo": seq} advances deliveredUpTo
+//	GET  /rooms/{appID}/signaling              the room's WebRTC negotiation state
+//
+// It shares mailbox semantics with /ws and /sse: messages stay queued until
+// acknowledged, and peers of either kind may share a room.
+func NewRESTHandler(
+	h *hub.Hub,
+	allowedOrigins []string,
+	lg *slog.Logger,
+	dev bool,
+	opts Options,
+) http.Handler {
+	allow := make(map[string]struct{}, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		allow[o] = struct{}{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !originOK(r, allow, dev) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/"), "/")
+		if len(parts) == 2 && parts[1] == "signaling" {
+			serveSignaling(w, r, h, parts[0], opts)
+			return
+		}
+		if len(parts) < 3 || parts[2] != "messages" || len(parts) > 4 || (len(parts) == 4 && parts[3] != "ack") {
+			http.NotFound(w, r)
+			return
+		}
+		appID, side, err := checkRoom(url.Values{"appID": {parts[0]}, "side": {parts[1]}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Polls only cost the client; posts also count against the room.
+		ok, wait := opts.IPLimit.Allow(opts.Proxies.ClientIP(r))
+		if ok && r.Method == http.MethodPost {
+			ok, wait = opts.RoomLimit.Allow(appID)
+		}
+		if !ok {
+			tooMany(w, wait)
+			return
+		}
+
+		switch {
+		case len(parts) == 4 && r.Method == http.MethodPost:
+			var m ackMsg
+			if err := decodeFrame(r, &m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.AckUpTo(appID, side, m.UpTo)
+			w.WriteHeader(http.StatusNoContent)
+
+		case len(parts) == 3 && r.Method == http.MethodPost:
+			var m postMessage
+			if err := decodeFrame(r, &m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if m.To == "" {
+				m.To = otherSide(side)
+			}
+			if len(m.Payload) == 0 {
+				http.Error(w, "payload required", http.StatusBadRequest)
+				return
+			}
+			seq, err := h.Enqueue(appID, side, m.To, hub.JSONPayload(m.Payload))
+			switch {
+			case errors.Is(err, hub.ErrInvalidSide):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			case errors.Is(err, hub.ErrBacklog):
+				lg.Warn("send enqueue failed", "err", err, "appID", appID)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string]any{"seq": seq, "to": m.To})
+
+		case len(parts) == 3 && r.Method == http.MethodGet:
+			after, wait, err := pollParams(r.URL.Query())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_ = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + writeWait))
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			defer cancel()
+			msgs, upTo, err := h.Wait(ctx, appID, side, after)
+			if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				switch {
+				case r.Context().Err() != nil:
+				case errors.Is(err, hub.ErrNotJSON):
+					http.Error(w, err.Error(), http.StatusNotAcceptable)
+				default:
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				return
+			}
+			if msgs == nil {
+				msgs = []hub.Message{}
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusOK, map[string]any{"messages": msgs, "deliveredUpTo": upTo})
+
+		default:
+			allow := "GET, POST"
+			if len(parts) == 4 {
+				allow = "POST"
+			}
+			w.Header().Set("Allow", allow)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// serveSignaling reports what the hub has seen of a room's offer/answer
+// exchange and ICE, for debugging stuck connections.
+func serveSignaling(w http.ResponseWriter, r *http.Request, h *hub.Hub, appID string, opts Options) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, _, err := checkRoom(url.Values{"appID": {appID}, "side": {"A"}}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok, wait := opts.IPLimit.Allow(opts.Proxies.ClientIP(r)); !ok {
+		tooMany(w, wait)
+		return
+	}
+	st, ok := h.Signaling(appID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, st)
+}
+
+// pollParams reads ?after=<seq>&wait=<duration>; wait also takes seconds.
+func pollParams(q url.Values) (after uint64, wait time.Duration, err error) {
+	if v := q.Get("after"); v != "" {
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return 0, 0, errors.New("invalid after")
+		}
+	}
+	wait = defaultPollWait
+	if v := q.Get("wait"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			wait = time.Duration(secs) * time.Second
+		} else if wait, err = time.ParseDuration(v); err != nil {
+			return 0, 0, errors.New("invalid wait")
+		}
+	}
+	if wait < 0 {
+		return 0, 0, errors.New("invalid wait")
+	}
+	return after, min(wait, maxPollWait), nil
+}
+
+// decodeFrame decodes a small JSON body into v.
+func decodeFrame(r *http.Request, v any) error {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxPostBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxPostBytes {
+		return errors.New("body too large")
+	}
+	return json.Unmarshal(b, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func otherSide(side string) string {
+	if side == "A" {
+		return "B"
+	}
+	return "A"
+}
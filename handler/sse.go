@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/hub"
+)
+
+const (
+	maxPostBytes  = 1 << 20          // body of a frame POSTed to the SSE endpoints
+	ssePingPeriod = 25 * time.Second // below common proxy idle timeouts
+)
+
+var errSSEClosed = errors.New("sse stream closed")
+
+// sseConn is a hub.Conn writing frames as Server-Sent Events. Writes come
+// from hub goroutines while the handler goroutine holds the stream open, so
+// closed guards the ResponseWriter once the handler is done with it.
+type sseConn struct {
+	mu     sync.Mutex
+	w      io.Writer
+	rc     *http.ResponseController
+	closed bool
+	done   chan struct{}
+}
+
+// writeLocked sends one event; data may span lines. Called with c.mu held.
+func (c *sseConn) writeLocked(event string, data []byte, timeout time.Duration) error {
+	if c.closed {
+		return errSSEClosed
+	}
+	var b bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(bytes.TrimSuffix(line, []byte("\r")))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	return c.writeRawLocked(b.Bytes(), timeout)
+}
+
+func (c *sseConn) writeRawLocked(p []byte, timeout time.Duration) error {
+	_ = c.rc.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.w.Write(p); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+// Codec is JSON: event streams are text.
+func (c *sseConn) Codec() hub.Codec { return hub.JSON }
+
+func (c *sseConn) WriteMessage(msg []byte, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeLocked("", msg, timeout)
+}
+
+// Ping writes an SSE comment, which clients ignore.
+func (c *sseConn) Ping(timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errSSEClosed
+	}
+	return c.writeRawLocked([]byte(": ping\n\n"), timeout)
+}
+
+// Close ends the stream. With a code, a "close" event tells the client why,
+// so it can stop EventSource from reconnecting when it was replaced.
+func (c *sseConn) Close(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	if code != 0 {
+		data, _ := json.Marshal(map[string]any{"code": code, "reason": reason})
+		_ = c.writeLocked("close", data, time.Second)
+	}
+	c.closed = true
+	close(c.done)
+	return nil
+}
+
+// NewSSEHandler serves the mailbox to clients that cannot use WebSockets.
+//
+//	GET  /sse?appID=&side=[&sid=]   event stream of the frames /ws would send
+//	POST /sse/hello|send|delivered  one frame of that type as the JSON body
+//	POST /sse/signal                an offer, answer or ice frame
+//
+// POSTs take the same query parameters as the stream and act for that side;
+// the body is the frame as it would be sent over /ws ("type" optional except
+// for signal). Mount it at both "/sse" and "/sse/".
+func NewSSEHandler(
+	h *hub.Hub,
+	allowedOrigins []string,
+	lg *slog.Logger,
+	dev bool,
+	opts Options,
+) http.Handler {
+	allow := make(map[string]struct{}, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		allow[o] = struct{}{}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !originOK(r, allow, dev) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		appID, side, err := checkRoom(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sessionID := r.URL.Query().Get("sid")
+		ip := opts.Proxies.ClientIP(r)
+
+		kind := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sse"), "/")
+		if kind == "" {
+			if r.Method != http.MethodGet {
+				w.Header().Set("Allow", "GET")
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			if ok, wait := opts.IPLimit.Allow(ip); !ok {
+				tooMany(w, wait)
+				return
+			}
+			serveStream(w, r, h, appID, side, sessionID, lg)
+			return
+		}
+		switch kind {
+		case "hello", "send", "delivered", "signal":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ok, wait := opts.allowFrame(appID, ip); !ok {
+			tooMany(w, wait)
+			return
+		}
+		msg, err := io.ReadAll(io.LimitReader(r.Body, maxPostBytes+1))
+		if err != nil {
+			http.Error(w, "read failed", http.StatusBadRequest)
+			return
+		}
+		if len(msg) > maxPostBytes {
+			http.Error(w, "frame too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		var peek struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(msg, &peek); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		typ := kind
+		if kind == "signal" {
+			typ = strings.ToLower(peek.Type)
+			if typ != "offer" && typ != "answer" && typ != "ice" {
+				http.Error(w, "signal type must be offer, answer or ice", http.StatusBadRequest)
+				return
+			}
+		} else if peek.Type != "" && !strings.EqualFold(peek.Type, kind) {
+			http.Error(w, fmt.Sprintf("frame type %q posted to /sse/%s", peek.Type, kind), http.StatusBadRequest)
+			return
+		}
+		if err := dispatch(h, appID, side, sessionID, hub.JSON, typ, msg); err != nil {
+			lg.Warn("frame rejected", "type", typ, "err", err)
+			status := http.StatusBadRequest
+			if errors.Is(err, hub.ErrSignalState) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// serveStream holds the event stream open until the client leaves or the
+// side is taken over by another connection.
+func serveStream(w http.ResponseWriter, r *http.Request, h *hub.Hub, appID, side, sessionID string, lg *slog.Logger) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's read and write timeouts; every write
+	// sets its own deadline instead.
+	_ = rc.SetReadDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // keep reverse proxies from buffering events
+	w.WriteHeader(http.StatusOK)
+
+	c := &sseConn{w: w, rc: rc, done: make(chan struct{})}
+	c.mu.Lock()
+	err := c.writeRawLocked([]byte("retry: 2000\n\n"), writeWait)
+	c.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	if err := h.Register(appID, side, sessionID, c); err != nil {
+		lg.Warn("hub register failed", "err", err, "appID", appID, "side", side)
+		return
+	}
+	defer h.Unregister(appID, c)
+	defer c.Close(0, "") // runs first: no hub write may touch w after we return
+	announceRoomFull(h, appID, lg)
+
+	ticker := time.NewTicker(ssePingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := h.WritePingConn(appID, c, writeWait); err != nil {
+				return
+			}
+		}
+	}
+}
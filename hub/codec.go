@@ -0,0 +1,192 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec is a wire encoding of the frame vocabulary. A connection picks one
+// when it is opened (the WebSocket subprotocol); the hub then encodes every
+// frame it sends there with it. Struct fields use their json tags in all
+// encodings, so frames look the same apart from the bytes.
+type Codec interface {
+	Name() string
+	// Binary reports whether frames go out as binary WebSocket messages.
+	Binary() bool
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// Fields splits an encoded map into its still-encoded members, so a
+	// payload can be passed on without being decoded.
+	Fields(data []byte) (map[string][]byte, error)
+	// Raw wraps data already in this encoding so Marshal embeds it as is.
+	Raw(data []byte) any
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	CBOR    Codec = cborCodec{}
+	MsgPack Codec = msgpackCodec{}
+)
+
+// CodecByName returns the codec called name ("json", "cbor", "msgpack").
+func CodecByName(name string) (Codec, bool) {
+	for _, c := range []Codec{JSON, CBOR, MsgPack} {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Payload is an encoded value tagged with its codec. Receivers using the
+// same codec get the bytes untouched; others get them transcoded, so raw
+// bytes stay raw between binary peers and become base64 only for JSON ones.
+type Payload struct {
+	Codec Codec
+	Data  []byte
+}
+
+// JSONPayload wraps a JSON value.
+func JSONPayload(raw json.RawMessage) Payload { return Payload{Codec: JSON, Data: raw} }
+
+// In returns the payload encoded with c.
+func (p Payload) In(c Codec) ([]byte, error) {
+	if p.Codec == nil || len(p.Data) == 0 {
+		return nil, nil
+	}
+	return Transcode(p.Data, p.Codec, c)
+}
+
+// Transcode re-encodes data from one codec to another.
+func Transcode(data []byte, from, to Codec) ([]byte, error) {
+	if from == to {
+		return data, nil
+	}
+	var v any
+	if err := from.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("transcode %s to %s: %w", from.Name(), to.Name(), err)
+	}
+	out, err := to.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("transcode %s to %s: %w", from.Name(), to.Name(), err)
+	}
+	return out, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                  { return "json" }
+func (jsonCodec) Binary() bool                  { return false }
+func (jsonCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+func (jsonCodec) Raw(data []byte) any           { return json.RawMessage(data) }
+
+// Unmarshal keeps integers exact when decoding into an interface, so they
+// stay integers when transcoded.
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if p, ok := v.(*any); ok {
+		*p = fromJSONNumbers(*p)
+	}
+	return nil
+}
+
+func (jsonCodec) Fields(data []byte) (map[string][]byte, error) {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func fromJSONNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = fromJSONNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = fromJSONNumbers(e)
+		}
+	}
+	return v
+}
+
+var (
+	cborEnc, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	cborDec, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+)
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string                       { return "cbor" }
+func (cborCodec) Binary() bool                       { return true }
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cborEnc.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cborDec.Unmarshal(data, v) }
+func (cborCodec) Raw(data []byte) any                { return cbor.RawMessage(data) }
+
+func (cborCodec) Fields(data []byte) (map[string][]byte, error) {
+	var m map[string]cbor.RawMessage
+	if err := cborDec.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "msgpack" }
+func (msgpackCodec) Binary() bool        { return true }
+func (msgpackCodec) Raw(data []byte) any { return msgpack.RawMessage(data) }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var b bytes.Buffer
+	enc := msgpack.NewEncoder(&b)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func (c msgpackCodec) Fields(data []byte) (map[string][]byte, error) {
+	var m map[string]msgpack.RawMessage
+	if err := c.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out, nil
+}
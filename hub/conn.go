@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is one peer's transport as the hub sees it: a WebSocket, or an SSE
+// stream for clients behind proxies that break WebSockets. Implementations
+// serialize their own writes.
+type Conn interface {
+	// Codec is the encoding frames written to this connection must use.
+	Codec() Codec
+	// WriteMessage sends one encoded frame, giving up after timeout.
+	WriteMessage(msg []byte, timeout time.Duration) error
+	// Ping keeps the transport alive while idle.
+	Ping(timeout time.Duration) error
+	// Close ends the connection, telling the peer why when possible.
+	Close(code int, reason string) error
+}
+
+// WSConn adapts a *websocket.Conn to Conn.
+type WSConn struct {
+	ws    *websocket.Conn
+	codec Codec
+	wmu   sync.Mutex // serialize *all* writes (WriteMessage/WriteJSON/WriteControl)
+}
+
+// NewWSConn wraps ws; frames are encoded with codec, as binary messages for
+// binary codecs and text otherwise.
+func NewWSConn(ws *websocket.Conn, codec Codec) *WSConn {
+	return &WSConn{ws: ws, codec: codec}
+}
+
+func (c *WSConn) Codec() Codec { return c.codec }
+
+func (c *WSConn) WriteMessage(msg []byte, timeout time.Duration) error {
+	mt := websocket.TextMessage
+	if c.codec.Binary() {
+		mt = websocket.BinaryMessage
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.ws.SetWriteDeadline(time.Now().Add(timeout))
+	return c.ws.WriteMessage(mt, msg)
+}
+
+func (c *WSConn) Ping(timeout time.Duration) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.ws.SetWriteDeadline(time.Now().Add(timeout))
+	return c.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+// Close sends a close frame (code 0 skips it) and closes the socket.
+func (c *WSConn) Close(code int, reason string) error {
+	if code != 0 {
+		c.wmu.Lock()
+		_ = c.ws.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+		c.wmu.Unlock()
+	}
+	return c.ws.Close()
+}
@@ -1,49 +1,77 @@
 package hub
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 const (
 	roomTTL          = 10 * time.Minute // keep state when both sides are offline
 	gcInterval       = 1 * time.Minute
-	maxMailboxQueued = 10000
+	MaxMailboxQueued = 10000 // messages a mailbox holds before Enqueue reports ErrBacklog
+	writeTimeout     = 10 * time.Second
 )
 
-type connWrap struct {
-	ws  *websocket.Conn
-	wmu sync.Mutex // serialize *all* writes (WriteMessage/WriteJSON/WriteControl)
+type deliverEnvelope struct {
+	Type    string `json:"type"` // "deliver"
+	Seq     uint64 `json:"seq"`
+	From    string `json:"from"`
+	Payload any    `json:"payload"` // the recipient codec's Raw
 }
 
-type deliverEnvelope struct {
-	Type    string          `json:"type"` // "deliver"
-	Seq     uint64          `json:"seq"`
-	From    string          `json:"from"`
-	Payload json.RawMessage `json:"payload"`
+// undeliverableEnvelope takes the place of a deliver frame whose payload the
+// recipient's codec cannot represent, e.g. a CBOR map with non-string keys
+// sent to a JSON client. The message stays queued until acknowledged, so
+// the client acks past it as it would a delivered one.
+type undeliverableEnvelope struct {
+	Type   string `json:"type"` // "undeliverable"
+	Seq    uint64 `json:"seq"`
+	From   string `json:"from"`
+	Reason string `json:"reason"`
 }
 
 type queued struct {
 	seq     uint64
 	from    string
-	payload json.RawMessage
+	payload Payload
 }
 
 type mailbox struct {
 	nextSeq       uint64
 	deliveredUpTo uint64
-	queue         []queued // kept sorted by seq ascending
+	queue         []queued      // kept sorted by seq ascending
+	wake          chan struct{} // closed on enqueue to release Wait callers; nil until one waits
+}
+
+// Message is a queued mailbox entry as handed to pollers (see Wait).
+type Message struct {
+	Seq     uint64          `json:"seq"`
+	From    string          `json:"from"`
+	Payload json.RawMessage `json:"payload"`
 }
 
+var (
+	// ErrBacklog is returned by Enqueue when the recipient's mailbox is full.
+	ErrBacklog = errors.New("backlog limit")
+	// ErrNotJSON is returned by Wait for a queued message that has no JSON
+	// representation, such as a CBOR map with non-string keys.
+	ErrNotJSON = errors.New("message not representable as JSON")
+	// ErrInvalidSide is returned for a side other than "A" or "B".
+	ErrInvalidSide = errors.New("invalid side (want A or B)")
+)
+
 type room struct {
-	conns        map[string]*connWrap // side -> conn
-	sids         map[string]string    // side -> sessionID (optional)
-	mboxes       map[string]*mailbox  // side -> mailbox
+	conns        map[string]Conn     // side -> conn
+	sids         map[string]string   // side -> sessionID (optional)
+	mboxes       map[string]*mailbox // side -> mailbox
+	signaling    *SignalingState     // nil until the first offer, answer or ice
 	lastActivity time.Time
+	joined       map[string]bool // sides that have held a connection
+	lastConn     time.Time       // when a connection last registered or left
 }
 
 type byConnKey struct {
@@ -52,15 +80,16 @@ type byConnKey struct {
 }
 
 type Hub struct {
-	mu     sync.Mutex
-	rooms  map[string]*room
-	byConn map[*websocket.Conn]byConnKey
+	mu      sync.Mutex
+	rooms   map[string]*room
+	byConn  map[Conn]byConnKey
+	onClose []func(appID string)
 }
 
 func NewHub() *Hub {
 	h := &Hub{
 		rooms:  make(map[string]*room),
-		byConn: make(map[*websocket.Conn]byConnKey),
+		byConn: make(map[Conn]byConnKey),
 	}
 	go h.gcLoop()
 	return h
@@ -72,52 +101,77 @@ func (h *Hub) gcLoop() {
 	for range ticker.C {
 		h.mu.Lock()
 		now := time.Now()
+		var closed []string
 		for appID, r := range h.rooms {
 			// delete only if no connections AND TTL expired
 			if len(r.conns) == 0 && now.Sub(r.lastActivity) > roomTTL {
 				delete(h.rooms, appID)
+				closed = append(closed, appID)
 			}
 		}
+		hooks := h.onClose
 		h.mu.Unlock()
+		for _, appID := range closed {
+			for _, fn := range hooks {
+				fn(appID)
+			}
+		}
 	}
 }
 
+// OnRoomClosed registers fn to run when a room is forgotten, so state tied
+// to it elsewhere (such as TURN credentials) can go with it.
+func (h *Hub) OnRoomClosed(fn func(appID string)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onClose = append(h.onClose, fn)
+}
+
+// RoomLive reports whether both sides of appID have connected, over /ws or
+// /sse, and one of them still is or left less than roomTTL ago. Mailbox
+// traffic alone, which anyone knowing the appID can produce, does not count.
+func (h *Hub) RoomLive(appID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.rooms[appID]
+	if r == nil || !r.joined["A"] || !r.joined["B"] {
+		return false
+	}
+	return len(r.conns) > 0 || time.Since(r.lastConn) < roomTTL
+}
+
+// Connected reports whether side of appID holds a connection.
+func (h *Hub) Connected(appID, side string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.rooms[appID]
+	return r != nil && r.conns[side] != nil
+}
+
 func (h *Hub) touch(r *room) {
 	r.lastActivity = time.Now()
 }
 
 // Register connection for (appID, side). Enforces one active conn per side.
-func (h *Hub) Register(appID, side, sid string, conn *websocket.Conn) error {
+func (h *Hub) Register(appID, side, sid string, conn Conn) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if side != "A" && side != "B" {
-		return errors.New("invalid side (want A or B)")
+		return ErrInvalidSide
 	}
 
-	r := h.rooms[appID]
-	if r == nil {
-		r = &room{
-			conns:        make(map[string]*connWrap, 2),
-			sids:         make(map[string]string, 2),
-			mboxes:       map[string]*mailbox{"A": {}, "B": {}},
-			lastActivity: time.Now(),
-		}
-		h.rooms[appID] = r
-	}
+	r := h.roomLocked(appID)
 
 	// Evict existing side (if any)
 	if old := r.conns[side]; old != nil {
-		// send close frame under write lock, then close
-		old.wmu.Lock()
-		_ = old.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(1000, "replaced"))
-		old.wmu.Unlock()
-		_ = old.ws.Close()
-		delete(h.byConn, old.ws)
-	}
-	wrap := &connWrap{ws: conn}
-	r.conns[side] = wrap
+		_ = old.Close(1000, "replaced")
+		delete(h.byConn, old)
+	}
+	r.conns[side] = conn
 	r.sids[side] = sid
+	r.joined[side] = true
+	r.lastConn = time.Now()
 	h.byConn[conn] = byConnKey{appID: appID, side: side}
 
 	h.touch(r) // mark activity
@@ -127,7 +181,7 @@ func (h *Hub) Register(appID, side, sid string, conn *websocket.Conn) error {
 	return nil
 }
 
-func (h *Hub) Unregister(appID string, conn *websocket.Conn) {
+func (h *Hub) Unregister(appID string, conn Conn) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -138,8 +192,9 @@ func (h *Hub) Unregister(appID string, conn *websocket.Conn) {
 	delete(h.byConn, conn)
 
 	if r := h.rooms[key.appID]; r != nil {
-		if w := r.conns[key.side]; w != nil && w.ws == conn {
+		if r.conns[key.side] == conn {
 			delete(r.conns, key.side)
+			r.lastConn = time.Now()
 		}
 	}
 }
@@ -153,39 +208,35 @@ func (h *Hub) RoomSize(appID string) int {
 	return 0
 }
 
-// Broadcast signaling to "the other" side(s).
-func (h *Hub) Broadcast(appID string, sender *websocket.Conn, msg []byte) {
+// Broadcast signaling to "the other" side(s). msg is in the sender's codec.
+func (h *Hub) Broadcast(appID string, sender Conn, msg []byte) {
 	h.mu.Lock()
 	key := h.byConn[sender]
+	h.mu.Unlock()
+	h.relay(appID, sender, key.side, Payload{Codec: sender.Codec(), Data: msg})
+}
+
+func (h *Hub) relay(appID string, sender Conn, fromSide string, msg Payload) {
+	h.mu.Lock()
 	r := h.rooms[appID]
-	var targets []*connWrap
+	var targets []Conn
 	if r != nil {
 		for side, c := range r.conns {
-			if c != nil && c.ws != sender && (key.side == "" || side != key.side) {
+			if c != nil && c != sender && (fromSide == "" || side != fromSide) {
 				targets = append(targets, c)
 			}
 		}
 	}
 	h.mu.Unlock()
 
-	// write outside hub lock, under each conn's write mutex
-	for _, c := range targets {
-		c.wmu.Lock()
-		_ = c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		err := c.ws.WriteMessage(websocket.TextMessage, msg)
-		c.wmu.Unlock()
-		if err != nil {
-			_ = c.ws.Close()
-			h.Unregister(appID, c.ws)
-		}
-	}
+	// write outside hub lock; each conn serializes its own writes
+	h.writeAll(appID, targets, func(c Codec) ([]byte, error) { return msg.In(c) })
 }
 
 func (h *Hub) BroadcastEvent(appID string, evt any) {
-	data, _ := json.Marshal(evt)
 	h.mu.Lock()
 	r := h.rooms[appID]
-	var conns []*connWrap
+	var conns []Conn
 	if r != nil {
 		for _, c := range r.conns {
 			if c != nil {
@@ -194,14 +245,24 @@ func (h *Hub) BroadcastEvent(appID string, evt any) {
 		}
 	}
 	h.mu.Unlock()
+	h.writeAll(appID, conns, func(c Codec) ([]byte, error) { return c.Marshal(evt) })
+}
+
+// writeAll sends a frame to each conn, encoded once per codec in use.
+func (h *Hub) writeAll(appID string, conns []Conn, encode func(Codec) ([]byte, error)) {
+	enc := make(map[Codec][]byte, 1)
 	for _, c := range conns {
-		c.wmu.Lock()
-		_ = c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		err := c.ws.WriteMessage(websocket.TextMessage, data)
-		c.wmu.Unlock()
-		if err != nil {
-			_ = c.ws.Close()
-			h.Unregister(appID, c.ws)
+		msg, ok := enc[c.Codec()]
+		if !ok {
+			var err error
+			if msg, err = encode(c.Codec()); err != nil {
+				continue // not representable in this codec
+			}
+			enc[c.Codec()] = msg
+		}
+		if err := c.WriteMessage(msg, writeTimeout); err != nil {
+			_ = c.Close(0, "")
+			h.Unregister(appID, c)
 		}
 	}
 }
@@ -215,11 +276,7 @@ func (h *Hub) Hello(appID, side, _sid string, deliveredUpTo uint64) {
 	if r == nil {
 		return
 	}
-	mb := r.mboxes[side]
-	if mb == nil {
-		mb = &mailbox{}
-		r.mboxes[side] = mb
-	}
+	mb := r.mailboxLocked(side)
 	if deliveredUpTo > mb.deliveredUpTo {
 		mb.deliveredUpTo = deliveredUpTo
 		// drop <= deliveredUpTo
@@ -229,45 +286,114 @@ func (h *Hub) Hello(appID, side, _sid string, deliveredUpTo uint64) {
 	h.touch(r)
 }
 
-// Enqueue adds a message for 'to' and attempts delivery.
-func (h *Hub) Enqueue(appID, from, to string, payload json.RawMessage) error {
+// Enqueue adds a message for 'to' and attempts delivery. It returns the
+// message's sequence number in the recipient's mailbox.
+func (h *Hub) Enqueue(appID, from, to string, payload Payload) (uint64, error) {
 	if to != "A" && to != "B" {
-		return errors.New("invalid 'to' (want A or B)")
+		return 0, fmt.Errorf("invalid 'to': %w", ErrInvalidSide)
 	}
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	return h.enqueueLocked(appID, from, to, payload)
+}
+
+func (h *Hub) enqueueLocked(appID, from, to string, payload Payload) (uint64, error) {
+	r := h.roomLocked(appID)
+	mb := r.mailboxLocked(to)
+
+	if len(mb.queue) >= MaxMailboxQueued {
+		// Refused rather than queued, so a sender retrying cannot grow it.
+		return 0, ErrBacklog
+	}
+	seq := mb.nextSeq + 1
+	mb.nextSeq = seq
+	mb.queue = append(mb.queue, queued{seq: seq, from: from, payload: payload})
+	if mb.wake != nil {
+		close(mb.wake)
+		mb.wake = nil
+	}
+
+	// best-effort push to online recipient
+	h.pushAllLocked(appID, to)
+	h.touch(r)
+
+	return seq, nil
+}
+
+// Wait returns the messages queued for side with seq > after, blocking until
+// there is at least one or ctx is done. It serves clients that poll instead
+// of holding a connection; the two can share a room. Messages stay queued
+// until acknowledged with AckUpTo. A message that cannot be transcoded to
+// JSON ends the batch; when it is the first, Wait returns ErrNotJSON naming
+// its seq, so the client can acknowledge past it.
+func (h *Hub) Wait(ctx context.Context, appID, side string, after uint64) ([]Message, uint64, error) {
+	if side != "A" && side != "B" {
+		return nil, 0, ErrInvalidSide
+	}
+	for {
+		h.mu.Lock()
+		r := h.roomLocked(appID)
+		mb := r.mailboxLocked(side)
+		h.touch(r)
+		upTo := mb.deliveredUpTo
+		var msgs []Message
+		var bad error
+		for _, q := range mb.queue {
+			if q.seq > after && q.seq > upTo {
+				data, err := q.payload.In(JSON)
+				if err != nil {
+					bad = fmt.Errorf("message %d: %w: %v", q.seq, ErrNotJSON, err)
+					break
+				}
+				msgs = append(msgs, Message{Seq: q.seq, From: q.from, Payload: data})
+			}
+		}
+		if len(msgs) > 0 {
+			h.mu.Unlock()
+			return msgs, upTo, nil
+		}
+		if bad != nil {
+			h.mu.Unlock()
+			return nil, upTo, bad
+		}
+		if mb.wake == nil {
+			mb.wake = make(chan struct{})
+		}
+		wake := mb.wake
+		h.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, upTo, ctx.Err()
+		}
+	}
+}
 
+// roomLocked returns the room for appID, creating it. Called with h.mu held.
+func (h *Hub) roomLocked(appID string) *room {
 	r := h.rooms[appID]
 	if r == nil {
 		r = &room{
-			conns:        make(map[string]*connWrap, 2),
+			conns:        make(map[string]Conn, 2),
 			sids:         make(map[string]string, 2),
 			mboxes:       map[string]*mailbox{"A": {}, "B": {}},
 			lastActivity: time.Now(),
+			joined:       make(map[string]bool, 2),
 		}
 		h.rooms[appID] = r
 	}
-	mb := r.mboxes[to]
+	return r
+}
+
+func (r *room) mailboxLocked(side string) *mailbox {
+	mb := r.mboxes[side]
 	if mb == nil {
 		mb = &mailbox{}
-		r.mboxes[to] = mb
-	}
-
-	seq := mb.nextSeq + 1
-	mb.nextSeq = seq
-	mb.queue = append(mb.queue, queued{seq: seq, from: from, payload: payload})
-	if len(mb.queue) > maxMailboxQueued {
-		// Drop oldest and signal pressure by forcing a close of the recipient (optional),
-		// or return an error. Here we drop and keep going.
-		return errors.New("backlog limit")
+		r.mboxes[side] = mb
 	}
-
-	// best-effort push to online recipient
-	h.pushAllLocked(appID, to)
-	h.touch(r)
-
-	return nil
+	return mb
 }
 
 // AckUpTo advances watermark and drops <= upTo for side.
@@ -304,8 +430,8 @@ func (h *Hub) pushAllLocked(appID, side string) {
 	if r == nil {
 		return
 	}
-	wrap := r.conns[side]
-	if wrap == nil {
+	cur := r.conns[side]
+	if cur == nil {
 		return
 	}
 	mb := r.mboxes[side]
@@ -316,21 +442,33 @@ func (h *Hub) pushAllLocked(appID, side string) {
 	// Snapshot frames to send and the connection we plan to use.
 	// Queue is append-only with strictly increasing seq; no need to sort.
 	upTo := mb.deliveredUpTo
-	frames := make([]deliverEnvelope, 0, len(mb.queue))
+	codec := cur.Codec()
+	frames := make([]any, 0, len(mb.queue))
 	for _, q := range mb.queue {
-		if q.seq > upTo {
-			frames = append(frames, deliverEnvelope{
-				Type: "deliver", Seq: q.seq, From: q.from, Payload: q.payload,
+		if q.seq <= upTo {
+			continue
+		}
+		data, err := q.payload.In(codec)
+		if err != nil {
+			frames = append(frames, undeliverableEnvelope{
+				Type: "undeliverable", Seq: q.seq, From: q.from, Reason: err.Error(),
 			})
+			continue
+		}
+		var payload any
+		if data != nil {
+			payload = codec.Raw(data)
 		}
+		frames = append(frames, deliverEnvelope{
+			Type: "deliver", Seq: q.seq, From: q.from, Payload: payload,
+		})
 	}
 	// Exit early if nothing to do.
 	if len(frames) == 0 {
 		return
 	}
 
-	// Keep a stable pointer for “replaced conn” detection after unlock.
-	cur := wrap
+	// cur stays the comparison key for “replaced conn” detection after unlock.
 	h.mu.Unlock()
 	// --- I/O outside hub lock ---
 	for _, env := range frames {
@@ -343,13 +481,13 @@ func (h *Hub) pushAllLocked(appID, side string) {
 			break
 		}
 
-		cur.wmu.Lock()
-		_ = cur.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		err := cur.ws.WriteJSON(env)
-		cur.wmu.Unlock()
+		data, err := codec.Marshal(env)
 		if err != nil {
-			_ = cur.ws.Close()
-			go h.Unregister(appID, cur.ws)
+			continue
+		}
+		if err := cur.WriteMessage(data, writeTimeout); err != nil {
+			_ = cur.Close(0, "")
+			go h.Unregister(appID, cur)
 			break
 		}
 	}
@@ -361,7 +499,7 @@ func (h *Hub) pushAllLocked(appID, side string) {
 	// caller expects us to hold h.mu on exit; keep that contract
 }
 
-func (h *Hub) WritePingConn(appID string, conn *websocket.Conn, deadline time.Duration) error {
+func (h *Hub) WritePingConn(appID string, conn Conn, deadline time.Duration) error {
 	h.mu.Lock()
 	key, ok := h.byConn[conn]
 	if !ok {
@@ -373,17 +511,13 @@ func (h *Hub) WritePingConn(appID string, conn *websocket.Conn, deadline time.Du
 		h.mu.Unlock()
 		return errors.New("room not found")
 	}
-	wrap := r.conns[key.side]
 	// only ping the same physical connection; if replaced, stop
-	if wrap == nil || wrap.ws != conn {
+	if r.conns[key.side] != conn {
 		h.mu.Unlock()
 		return errors.New("connection replaced")
 	}
-	// hold the wrap pointer; release hub lock before doing IO
+	// release hub lock before doing IO
 	h.mu.Unlock()
 
-	wrap.wmu.Lock()
-	defer wrap.wmu.Unlock()
-	_ = wrap.ws.SetWriteDeadline(time.Now().Add(deadline))
-	return wrap.ws.WriteMessage(websocket.PingMessage, nil)
+	return conn.Ping(deadline)
 }
@@ -0,0 +1,254 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MaxSDPBytes       = 64 << 10 // largest session description relayed
+	maxCandidateBytes = 1 << 10  // an ICE candidate line is well under this
+)
+
+var (
+	// ErrBadSignal is returned by Signal for malformed offer, answer or ice
+	// frames.
+	ErrBadSignal = errors.New("invalid signaling frame")
+	// ErrSignalState is returned by Signal for frames out of order, such as
+	// an answer without an offer from the other side.
+	ErrSignalState = errors.New("unexpected signaling frame")
+)
+
+// Negotiation states of a room's offer/answer exchange.
+const (
+	SignalIdle     = "idle"     // no offer yet
+	SignalOffered  = "offered"  // an offer awaits its answer
+	SignalAnswered = "answered" // the last offer was answered
+)
+
+// SignalingState is what the hub knows of a room's WebRTC negotiation.
+type SignalingState struct {
+	State    string                   `json:"state"`
+	Offerer  string                   `json:"offerer,omitempty"` // side that sent the last offer
+	Restarts int                      `json:"restarts"`          // ICE restarts after the first offer
+	Sides    map[string]SideSignaling `json:"sides"`
+	Updated  time.Time                `json:"updated,omitzero"`
+}
+
+// SideSignaling tracks one side's ICE.
+type SideSignaling struct {
+	Ufrag      string `json:"ufrag,omitempty"` // ice-ufrag of its last description
+	Candidates int    `json:"candidates"`      // relayed in the current ICE generation
+	Gathered   bool   `json:"gathered"`        // sent end-of-candidates
+}
+
+// signalFrame holds the fields of offer, answer and ice frames the hub
+// checks. A candidate is either the RTCIceCandidate JSON object or its
+// candidate line; null, absent or an empty line mean end-of-candidates.
+type signalFrame struct {
+	Type      string `json:"type"`
+	SDP       string `json:"sdp"`
+	Candidate any    `json:"candidate"`
+}
+
+// Signal relays an offer, answer or ice frame from side to the other side
+// of the room, tracking the negotiation. Frames for a peer that is offline,
+// or whose connection fails the write, are queued in its mailbox and arrive
+// as deliveries once it connects.
+func (h *Hub) Signal(appID, side string, msg Payload) error {
+	if side != "A" && side != "B" {
+		return ErrInvalidSide
+	}
+	var f signalFrame
+	if err := msg.Codec.Unmarshal(msg.Data, &f); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignal, err)
+	}
+	typ := strings.ToLower(f.Type)
+	var ufrag, cand string
+	var err error
+	switch typ {
+	case "offer", "answer":
+		ufrag, err = checkSDP(f.SDP)
+	case "ice":
+		cand, ufrag, err = checkCandidate(f.Candidate)
+	default:
+		err = fmt.Errorf("%w: type %q", ErrBadSignal, f.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	r := h.roomLocked(appID)
+	if r.signaling == nil {
+		r.signaling = newSignaling()
+	}
+	if err := r.signaling.apply(side, typ, ufrag, cand); err != nil {
+		h.mu.Unlock()
+		return err
+	}
+	h.touch(r)
+	peer := otherSide(side)
+	target := r.conns[peer]
+	if target == nil {
+		defer h.mu.Unlock()
+		if _, err := h.enqueueLocked(appID, side, peer, msg); err != nil {
+			return fmt.Errorf("queue signaling: %w", err)
+		}
+		return nil
+	}
+	h.mu.Unlock()
+
+	data, err := msg.In(target.Codec())
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignal, err)
+	}
+	if err := target.WriteMessage(data, writeTimeout); err == nil {
+		return nil
+	}
+	_ = target.Close(0, "")
+	h.Unregister(appID, target)
+	if _, err := h.Enqueue(appID, side, peer, msg); err != nil {
+		return fmt.Errorf("queue signaling: %w", err)
+	}
+	return nil
+}
+
+// Signaling reports the negotiation state of a room.
+func (h *Hub) Signaling(appID string) (SignalingState, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := h.rooms[appID]
+	if r == nil {
+		return SignalingState{}, false
+	}
+	if r.signaling == nil {
+		return *newSignaling(), true
+	}
+	s := *r.signaling
+	s.Sides = make(map[string]SideSignaling, 2)
+	for k, v := range r.signaling.Sides {
+		s.Sides[k] = v
+	}
+	return s, true
+}
+
+func newSignaling() *SignalingState {
+	return &SignalingState{State: SignalIdle, Sides: map[string]SideSignaling{"A": {}, "B": {}}}
+}
+
+// apply advances the state for a validated frame from side. An offer whose
+// ice-ufrag differs from the side's previous one is an ICE restart: both
+// sides gather anew, and candidates of the old generation are refused.
+func (s *SignalingState) apply(side, typ, ufrag, cand string) error {
+	me := s.Sides[side]
+	switch typ {
+	case "offer":
+		if me.Ufrag != "" && ufrag != "" && ufrag != me.Ufrag {
+			s.Restarts++
+			for k, v := range s.Sides {
+				v.Candidates, v.Gathered = 0, false
+				s.Sides[k] = v
+			}
+			me = s.Sides[side]
+		}
+		s.State, s.Offerer = SignalOffered, side
+		me.Ufrag = ufrag
+	case "answer":
+		if s.State != SignalOffered || s.Offerer == side {
+			return fmt.Errorf("%w: answer from %s without an offer from the other side", ErrSignalState, side)
+		}
+		if me.Ufrag != "" && ufrag != "" && ufrag != me.Ufrag {
+			me.Candidates, me.Gathered = 0, false
+		}
+		s.State = SignalAnswered
+		me.Ufrag = ufrag
+	case "ice":
+		if ufrag != "" && me.Ufrag != "" && ufrag != me.Ufrag {
+			return fmt.Errorf("%w: candidate from a previous ICE generation", ErrSignalState)
+		}
+		if cand == "" {
+			me.Gathered = true
+		} else {
+			me.Candidates++
+		}
+	}
+	s.Sides[side] = me
+	s.Updated = time.Now()
+	return nil
+}
+
+// checkSDP checks the structure of a session description (RFC 8866): type=
+// lines starting with v=0, o=, s= and t=, and at least one media section.
+// It returns the first ice-ufrag, if any.
+func checkSDP(sdp string) (ufrag string, err error) {
+	bad := func(why string) (string, error) { return "", fmt.Errorf("%w: sdp %s", ErrBadSignal, why) }
+	switch {
+	case sdp == "":
+		return bad("missing")
+	case len(sdp) > MaxSDPBytes:
+		return bad(fmt.Sprintf("over %d bytes", MaxSDPBytes))
+	}
+	seen := map[byte]bool{}
+	lines := strings.Split(strings.TrimRight(sdp, "\r\n"), "\n")
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) < 2 || line[1] != '=' || line[0] < 'a' || line[0] > 'z' {
+			return bad(fmt.Sprintf("line %d is not <type>=<value>", i+1))
+		}
+		if i == 0 && line != "v=0" {
+			return bad("must start with v=0")
+		}
+		seen[line[0]] = true
+		if v, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok && ufrag == "" {
+			ufrag = strings.TrimSpace(v)
+		}
+	}
+	for _, t := range []byte("ostm") {
+		if !seen[t] {
+			return bad(fmt.Sprintf("has no %c= line", t))
+		}
+	}
+	return ufrag, nil
+}
+
+// checkCandidate returns the candidate line ("" for end-of-candidates) and
+// its usernameFragment, if given.
+func checkCandidate(c any) (line, ufrag string, err error) {
+	switch c := c.(type) {
+	case nil:
+	case string:
+		line = c
+	case map[string]any:
+		var ok bool
+		if v, present := c["candidate"]; present && v != nil {
+			if line, ok = v.(string); !ok {
+				return "", "", fmt.Errorf("%w: candidate.candidate is not a string", ErrBadSignal)
+			}
+		}
+		if v, present := c["usernameFragment"]; present && v != nil {
+			if ufrag, ok = v.(string); !ok {
+				return "", "", fmt.Errorf("%w: candidate.usernameFragment is not a string", ErrBadSignal)
+			}
+		}
+	default:
+		return "", "", fmt.Errorf("%w: candidate must be an object or a string", ErrBadSignal)
+	}
+	line = strings.TrimPrefix(strings.TrimSpace(line), "a=")
+	switch {
+	case len(line) > maxCandidateBytes:
+		return "", "", fmt.Errorf("%w: candidate over %d bytes", ErrBadSignal, maxCandidateBytes)
+	case line != "" && !strings.HasPrefix(line, "candidate:"):
+		return "", "", fmt.Errorf("%w: candidate line must start with candidate:", ErrBadSignal)
+	}
+	return line, ufrag, nil
+}
+
+func otherSide(side string) string {
+	if side == "A" {
+		return "B"
+	}
+	return "A"
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+// Offline maintenance commands for the fs store. They open the index, which
+// only one process may hold, so the server must be stopped first.
+var commands = map[string]func(args []string) error{
+	"fsck":    fsckCmd,
+	"genkey":  genkeyCmd,
+	"reindex": reindexCmd,
+	"ls":      lsCmd,
+}
+
+// genkeyCmd prints a new key-file line for -encrypt_keyfile or
+// -turn_secrets. Appending it makes it the active key; older lines stay for
+// reading existing objects or verifying credentials already handed out.
+func genkeyCmd(args []string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", time.Now().UTC().Format("20060102T150405Z"), base64.StdEncoding.EncodeToString(key))
+	return nil
+}
+
+// fsckCmd reports (and with -repair fixes) inconsistencies in the fs store.
+func fsckCmd(args []string) error {
+	fl := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dataDir := fl.String("data", "./data", "data directory of the fs store")
+	repair := fl.Bool("repair", false, "fix the problems found")
+	verify := fl.Bool("verify", false, "re-hash every blob instead of only checking sizes")
+	_ = fl.Parse(args)
+
+	rep, err := storage.Fsck(*dataDir, storage.FsckOptions{Repair: *repair, Verify: *verify})
+	for _, is := range rep.Issues {
+		fmt.Println(is)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d objects, %d problems\n", rep.Objects, len(rep.Issues))
+	if len(rep.Issues) > 0 && !*repair {
+		return fmt.Errorf("problems found; run with -repair to fix them")
+	}
+	return nil
+}
+
+func reindexCmd(args []string) error {
+	fl := flag.NewFlagSet("reindex", flag.ExitOnError)
+	dataDir := fl.String("data", "./data", "data directory of the fs store")
+	_ = fl.Parse(args)
+
+	s, err := storage.NewFSStore(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	n, err := s.RebuildIndex()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("indexed %d objects\n", n)
+	return nil
+}
+
+// lsCmd prints one JSON line per object matching the filters.
+func lsCmd(args []string) error {
+	fl := flag.NewFlagSet("ls", flag.ExitOnError)
+	dataDir := fl.String("data", "./data", "data directory of the fs store")
+	state := fl.String("state", "", "only objects in this state")
+	owner := fl.String("owner", "", "only objects with this owner hash")
+	_ = fl.Parse(args)
+
+	s, err := storage.NewFSStore(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	enc := json.NewEncoder(os.Stdout)
+	var encErr error
+	err = s.List(storage.Query{State: storage.State(*state), OwnerHash: *owner}, func(id storage.ObjectID, m storage.Meta) bool {
+		encErr = enc.Encode(struct {
+			ID storage.ObjectID `json:"id"`
+			storage.Meta
+		}{id, m})
+		return encErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return encErr
+}
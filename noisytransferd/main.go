@@ -4,47 +4,201 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/collapsinghierarchy/noisytransfer/api"
 	"github.com/collapsinghierarchy/noisytransfer/handler"
 	"github.com/collapsinghierarchy/noisytransfer/hub"
+	"github.com/collapsinghierarchy/noisytransfer/ratelimit"
 	"github.com/collapsinghierarchy/noisytransfer/storage"
 	"github.com/collapsinghierarchy/noisytransfer/turn"
+	"github.com/santhosh-tekuri/jsonschema/v6"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	addr := flag.String("addr", ":1234", "HTTP listen address")
 	dev := flag.Bool("dev", false, "allow empty Origin / any Origin on WebSocket upgrades")
-	dataDir := flag.String("data", "./data", "data directory for objects")
+	storeKind := flag.String("store", "fs", "object store backend: fs, s3 or mem")
+	memMax := flag.Int64("mem_max_bytes", 1<<30, "total bytes held by the mem store (0 = unlimited)")
+	memMaxObject := flag.Int64("mem_max_object", 0, "largest blob accepted by the mem store (0 = unlimited)")
+	dataDir := flag.String("data", "./data", "data directory for objects (fs store)")
+	dedup := flag.Bool("dedup", false, "store identical committed blobs once, by content hash (fs store)")
+	s3Endpoint := flag.String("s3_endpoint", "", "S3-compatible endpoint URL (s3 store)")
+	s3Region := flag.String("s3_region", "us-east-1", "S3 signing region")
+	s3Bucket := flag.String("s3_bucket", "", "S3 bucket")
+	s3Prefix := flag.String("s3_prefix", "", "S3 key prefix")
+	s3PathStyle := flag.Bool("s3_path_style", true, "use path-style bucket addressing")
 	baseURL := flag.String("base", "http://localhost:1234", "public base URL")
 	corsOrigin := flag.String("cors", "*", "CORS allowed origin")
-	gcTTL := flag.Duration("gc_ttl", 24*time.Hour, "GC TTL for objects")
+	uncommittedTTL := flag.Duration("ttl_uncommitted", 1*time.Hour, "idle time allowed before an object is committed")
+	committedTTL := flag.Duration("ttl_committed", 24*time.Hour, "default object lifetime after commit")
+	maxTTL := flag.Duration("ttl_max", 7*24*time.Hour, "upper bound for client-requested lifetimes")
+	tombstoneTTL := flag.Duration("tombstone_ttl", 24*time.Hour, "how long deleted/expired objects answer 410 Gone (0 = never purge)")
+	gcInterval := flag.Duration("gc_interval", 10*time.Minute, "how often expired objects are swept")
+	keyFile := flag.String("encrypt_keyfile", "", "encrypt blobs and manifests at rest with the keys in this file")
+	manifestMax := flag.Int64("manifest_max_bytes", api.DefaultManifestMax, "largest manifest accepted")
+	manifestSchemas := flag.String("manifest_schemas", "", "directory of v<version>.json JSON Schemas manifests must match")
+	maxFrame := flag.Int64("max_frame_bytes", 0, "largest WebSocket frame accepted from a client (0 = 1 MiB for protocol v2, unlimited for v1)")
+	maxObject := flag.Int64("quota_object_bytes", 0, "largest blob accepted (0 = unlimited)")
+	ownerQuota := flag.Int64("quota_owner_bytes", 0, "live bytes allowed per owner token (0 = unlimited; fs and mem stores)")
+	roomQuota := flag.Int64("quota_room_bytes", 0, "live bytes allowed per hub room objects are linked to (0 = unlimited; fs and mem stores)")
+	clientQuota := flag.Int64("quota_client_bytes", 0, "live bytes allowed per client address, IPv6 per /64 (0 = same as -quota_owner_bytes; fs and mem stores)")
+	totalQuota := flag.Int64("quota_total_bytes", 0, "high-watermark for all live bytes (0 = unlimited; fs and mem stores)")
+	// Rates are "<per-second>[:<burst>]"; 0 disables.
+	connRate := ratelimit.Rate{PerSec: 50, Burst: 100}
+	roomRate := ratelimit.Rate{PerSec: 100, Burst: 200}
+	frameIPRate := ratelimit.Rate{PerSec: 200, Burst: 400}
+	httpIPRate := ratelimit.Rate{PerSec: 50, Burst: 100}
+	flag.Var(&connRate, "rate_conn", "frames per second allowed on one WebSocket connection")
+	flag.Var(&roomRate, "rate_room", "frames per second allowed into one room, over all transports")
+	flag.Var(&frameIPRate, "rate_ip", "mailbox frames and requests per second allowed from one client IP")
+	flag.Var(&httpIPRate, "rate_http_ip", "object API requests per second allowed from one client IP")
+	turnSecrets := flag.String("turn_secrets", "", "file of TURN REST shared secrets, last one active (default: one random secret per run)")
+	turnTTL := flag.Duration("turn_ttl", handler.DefaultCredentialTTL, "lifetime of TURN credentials issued by /ice-servers")
+	turnMaxAlloc := flag.Duration("turn_max_allocation", 2*time.Hour, "how long a TURN credential authenticates after first use (0 = until it expires)")
+	stunURLs := flag.String("stun_urls", "stun:localhost:3478", "comma-separated STUN URLs advertised by /ice-servers")
+	turnURLs := flag.String("turn_urls", "turn:localhost:3478?transport=udp,turn:localhost:3478?transport=tcp", "comma-separated TURN URLs advertised by /ice-servers")
+	trustedProxies := flag.String("trusted_proxies", "", "comma-separated addresses/CIDRs of proxies whose X-Forwarded-For is believed")
 	flag.Parse()
 
 	log := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
 
-	store, err := storage.NewFSStore(*dataDir)
+	var store storage.Store
+	var err error
+	switch *storeKind {
+	case "fs":
+		var fs *storage.FSStore
+		if fs, err = storage.NewFSStore(*dataDir); err == nil {
+			for _, is := range fs.Recovered() {
+				log.Warn("store recovery", "path", is.Path, "problem", is.Problem, "action", is.Action)
+			}
+			fs.Dedup = *dedup
+			store = fs
+			defer fs.Close()
+		}
+	case "s3":
+		// Credentials come from the standard AWS environment variables.
+		store, err = storage.NewS3Store(storage.S3Config{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			PathStyle: *s3PathStyle,
+			Logger:    log,
+		})
+	case "mem":
+		store = storage.NewMemStore(*memMax, *memMaxObject)
+	default:
+		err = fmt.Errorf("unknown store %q", *storeKind)
+	}
+	if err == nil && *keyFile != "" {
+		var keys *storage.Keyring
+		if keys, err = storage.LoadKeyring(*keyFile); err == nil {
+			store, err = storage.NewEncryptedStore(store, keys)
+			log.Info("encryption at rest", "activeKey", keys.Active())
+		}
+	}
+	if err != nil {
+		log.Error("store", "kind", *storeKind, "err", err)
+		os.Exit(1)
+	}
+
+	proxies, err := ratelimit.ParseProxies(*trustedProxies)
 	if err != nil {
-		log.Error("fsstore", "err", err)
+		log.Error("trusted proxies", "err", err)
 		os.Exit(1)
 	}
 
-	apiSrv := &api.Server{Store: store, BaseURL: *baseURL, TTL: *gcTTL}
+	secrets := turn.RandomSecrets()
+	if *turnSecrets != "" {
+		if secrets, err = turn.LoadSecrets(*turnSecrets); err != nil {
+			log.Error("turn secrets", "err", err)
+			os.Exit(1)
+		}
+		log.Info("TURN secrets", "active", secrets.Active())
+	}
+
+	var schemas map[string]*jsonschema.Schema
+	if *manifestSchemas != "" {
+		if schemas, err = api.LoadManifestSchemas(*manifestSchemas); err != nil {
+			log.Error("manifest schemas", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	apiSrv := &api.Server{Store: store, BaseURL: *baseURL, Policy: api.Policy{
+		UncommittedTTL: *uncommittedTTL,
+		CommittedTTL:   *committedTTL,
+		MaxTTL:         *maxTTL,
+		TombstoneTTL:   *tombstoneTTL,
+	}, Quota: api.Quota{
+		MaxObjectBytes: *maxObject,
+		MaxOwnerBytes:  *ownerQuota,
+		MaxRoomBytes:   *roomQuota,
+		MaxClientBytes: *clientQuota,
+		MaxTotalBytes:  *totalQuota,
+	}, Manifest: api.ManifestPolicy{
+		MaxBytes: *manifestMax,
+		Schemas:  schemas,
+	}, RateLimit: api.RateLimit{
+		PerIP:   ratelimit.NewLimiter(httpIPRate),
+		Proxies: proxies,
+	}}
 
 	mux := http.NewServeMux()
 	h := hub.NewHub()
+	apiSrv.Events = h
 
-	ws := handler.NewWSHandler(h, []string{"http://localhost:9200"}, log.With("sys", "ws"), *dev)
+	opts := handler.Options{
+		MaxFrameBytes: *maxFrame,
+		Features:      []string{"object_events"},
+		ConnRate:      connRate,
+		RoomLimit:     ratelimit.NewLimiter(roomRate),
+		IPLimit:       ratelimit.NewLimiter(frameIPRate),
+		Proxies:       proxies,
+	}
+	ws := handler.NewWSHandler(h, []string{"http://localhost:9200"}, log.With("sys", "ws"), *dev, opts)
 
 	// WS mailbox stays exactly as you have it:
 	mux.Handle("/ws", ws)
 
+	// SSE fallback for clients whose proxies break WebSockets.
+	sse := handler.NewSSEHandler(h, []string{"http://localhost:9200"}, log.With("sys", "sse"), *dev, opts)
+	mux.Handle("/sse", sse)
+	mux.Handle("/sse/", sse)
+
+	// Long-poll REST mailbox for server-to-server integrations.
+	mux.Handle("/rooms/", handler.NewRESTHandler(h, []string{"http://localhost:9200"}, log.With("sys", "rest"), *dev, opts))
+
+	// STUN/TURN servers and ephemeral TURN credentials for RTCPeerConnection.
+	// Room-scoped TURN credentials die with their room.
+	h.OnRoomClosed(secrets.Revoke)
+	mux.Handle("/ice-servers", handler.NewICEServersHandler(h, handler.ICEConfig{
+		STUN:    splitList(*stunURLs),
+		TURN:    splitList(*turnURLs),
+		Secrets: secrets,
+		TTL:     *turnTTL,
+	}, []string{"http://localhost:9200"}, log.With("sys", "ice"), *dev, opts))
+
 	// HTTP data plane:
 	apiSrv.Register(mux)
 	srv := &http.Server{
@@ -60,14 +214,30 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	apiSrv.StartGC(ctx)
+	apiSrv.StartGC(ctx, *gcInterval)
+
+	if *turnSecrets != "" {
+		// SIGHUP re-reads the TURN secrets, for rotation without a restart.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := secrets.Reload(); err != nil {
+					log.Error("turn secrets reload", "err", err)
+					continue
+				}
+				log.Info("TURN secrets reloaded", "active", secrets.Active())
+			}
+		}()
+	}
 
 	go func() {
 		if err := turn.Start(ctx, turn.Config{
-			Realm:    "example.com",
-			Username: "testuser",
-			Password: "testpass",
-			Logger:   log.With("sys", "turn"),
+			Realm:         "example.com",
+			Secrets:       secrets,
+			MaxAllocation: *turnMaxAlloc,
+			RoomLive:      h.RoomLive,
+			Logger:        log.With("sys", "turn"),
 		}); err != nil && !errors.Is(err, context.Canceled) {
 			log.Error("turn server", "err", err)
 		}
@@ -88,13 +258,25 @@ func main() {
 	log.Info("server stopped")
 }
 
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
 func withCORS(next http.Handler, origin string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Vary", "Origin")
 			w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,POST,PUT,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,X-Download-ID")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag,X-Request-ID,X-Expires-At,X-Download-ID")
 		}
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
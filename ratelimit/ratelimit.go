@@ -0,0 +1,140 @@
+// Package ratelimit provides the token buckets that protect the hub and the
+// object API from clients sending faster than they should.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate is a token bucket: Burst tokens, refilled at PerSec a second. The
+// zero Rate is unlimited.
+type Rate struct {
+	PerSec float64
+	Burst  int
+}
+
+// Enabled reports whether r limits anything.
+func (r Rate) Enabled() bool { return r.PerSec > 0 }
+
+// String formats r as Set parses it, "<per-second>[:<burst>]".
+func (r Rate) String() string {
+	if !r.Enabled() {
+		return "0"
+	}
+	return strconv.FormatFloat(r.PerSec, 'f', -1, 64) + ":" + strconv.Itoa(r.Burst)
+}
+
+// Set parses "<per-second>[:<burst>]"; the burst defaults to twice the
+// rate, and "0" disables the limit. Rate is a flag.Value.
+func (r *Rate) Set(s string) error {
+	perSec, burst, hasBurst := strings.Cut(s, ":")
+	v, err := strconv.ParseFloat(perSec, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) {
+		return fmt.Errorf("invalid rate %q", s)
+	}
+	b := int(math.Ceil(2 * v))
+	if hasBurst {
+		if b, err = strconv.Atoi(burst); err != nil || b < 1 {
+			return fmt.Errorf("invalid burst in %q", s)
+		}
+	}
+	*r = Rate{PerSec: v, Burst: max(b, 1)}
+	if v == 0 {
+		*r = Rate{}
+	}
+	return nil
+}
+
+// Bucket is a single token bucket, e.g. for one connection.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(r Rate) *Bucket {
+	return &Bucket{rate: r, tokens: float64(r.Burst)}
+}
+
+// Allow takes a token if one is available. Otherwise it reports how long
+// until the next one.
+func (b *Bucket) Allow() (bool, time.Duration) {
+	if b == nil || !b.rate.Enabled() {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allowLocked(time.Now())
+}
+
+func (b *Bucket) allowLocked(now time.Time) (bool, time.Duration) {
+	if !b.last.IsZero() {
+		b.tokens = min(float64(b.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSec)
+	}
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate.PerSec * float64(time.Second))
+	return false, wait
+}
+
+// full reports whether the bucket would be back at Burst by now, so
+// dropping it loses nothing. Called with b.mu held.
+func (b *Bucket) fullLocked(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSec >= float64(b.rate.Burst)
+}
+
+// sweepEvery is how often a Limiter drops buckets that have refilled.
+const sweepEvery = time.Minute
+
+// Limiter keeps one bucket per key, such as a room or a client IP. A nil
+// Limiter, or one with the zero Rate, allows everything.
+type Limiter struct {
+	rate Rate
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+func NewLimiter(r Rate) *Limiter {
+	return &Limiter{rate: r, buckets: make(map[string]*Bucket)}
+}
+
+// Allow takes a token from key's bucket, or reports how long to wait.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil || !l.rate.Enabled() {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= sweepEvery {
+		l.lastSweep = now
+		for k, b := range l.buckets {
+			if b.fullLocked(now) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = NewBucket(l.rate)
+		l.buckets[key] = b
+	}
+	return b.allowLocked(now)
+}
+
+// RetryAfter formats wait for a Retry-After header: whole seconds, rounded
+// up, at least one.
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1))
+}
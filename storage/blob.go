@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// Blob is an open, seekable view of a committed blob. Every Store returns
+// one from OpenBlob so callers can serve Range requests without knowing
+// whether the bytes live on disk, in memory or in a bucket.
+type Blob interface {
+	io.ReadSeekCloser
+	Info() BlobInfo
+}
+
+// BlobInfo describes the content behind a Blob.
+type BlobInfo struct {
+	Size        int64
+	ModTime     time.Time // commit time
+	ETag        string    // hex SHA-256 of the content
+	ContentType string
+}
+
+// NewBlob pairs a reader with its description; Store implementations and
+// wrapping stores use it to build their Blob values.
+func NewBlob(r io.ReadSeekCloser, info BlobInfo) Blob {
+	if info.ContentType == "" {
+		info.ContentType = "application/octet-stream"
+	}
+	return &blob{ReadSeekCloser: r, info: info}
+}
+
+type blob struct {
+	io.ReadSeekCloser
+	info BlobInfo
+}
+
+func (b *blob) Info() BlobInfo { return b.info }
+
+// blobInfo derives the BlobInfo of a committed object from its meta.
+func blobInfo(m Meta) BlobInfo {
+	return BlobInfo{Size: m.Size, ModTime: m.CommittedAt, ETag: m.ETag}
+}
@@ -0,0 +1,504 @@
+package storage
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// AttrStore is implemented by stores that keep Meta.Attrs for wrappers.
+type AttrStore interface {
+	Store
+	SetAttrs(ctx context.Context, id ObjectID, attrs map[string]string) (Meta, error)
+}
+
+// EncryptedStore encrypts blobs and manifests before they reach the wrapped
+// store. Each blob or manifest gets a fresh AES-256-GCM data key, wrapped
+// with the keyring's active key and stored in a header in front of the
+// ciphertext:
+//
+//	"NTE1" | chunk size u32 | key id len u8 | key id | wrapped len u16 | wrapped key
+//
+// The plaintext is then sealed in fixed-size chunks, each authenticated with
+// the object id, its index and whether it is the last one, so chunks cannot
+// be swapped, reordered or truncated away, and a Range read only decrypts
+// the chunks it touches.
+//
+// The wrapped store sees ciphertext sizes and hashes; the plaintext Size and
+// ETag are wrapped with the keyring into Attrs, bound to the object and the
+// ciphertext ETag they were computed with, and reported in their place. The
+// rest of Meta stays readable: the store needs states, timestamps and owner
+// digests to operate.
+type EncryptedStore struct {
+	Store // the wrapped store; Create, Delete and GC pass straight through
+
+	inner AttrStore
+	keys  *Keyring
+}
+
+// encChunk is the plaintext size of one sealed chunk.
+const encChunk = 64 << 10
+
+const (
+	attrPlain      = "enc.plain" // "<key id>:<base64 wrapped "<size> <etag>">"
+	attrCipherETag = "enc.cipherEtag"
+)
+
+var encMagic = []byte("NTE1")
+
+// NewEncryptedStore wraps inner, which must be able to keep Attrs.
+func NewEncryptedStore(inner Store, keys *Keyring) (*EncryptedStore, error) {
+	as, ok := inner.(AttrStore)
+	if !ok {
+		return nil, fmt.Errorf("encryption: %T cannot keep object attributes", inner)
+	}
+	return &EncryptedStore{Store: inner, inner: as, keys: keys}, nil
+}
+
+func (s *EncryptedStore) PutBlob(ctx context.Context, id ObjectID, r io.Reader) (int64, string, error) {
+	pr, pw := io.Pipe()
+	h := sha256.New()
+	var n int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := s.seal(pw, id, "blob")
+		if err == nil {
+			n, err = io.Copy(w, io.TeeReader(r, h))
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	_, cipherETag, err := s.inner.PutBlob(ctx, id, pr)
+	pr.Close() // unblocks the sealer if the store stopped reading early
+	<-done
+	if err != nil {
+		return 0, "", err
+	}
+	etag := hex.EncodeToString(h.Sum(nil))
+	kid, wrapped, err := s.keys.wrap([]byte(strconv.FormatInt(n, 10)+" "+etag), plainAD(id, cipherETag))
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := s.inner.SetAttrs(ctx, id, map[string]string{
+		attrPlain:      kid + ":" + base64.RawStdEncoding.EncodeToString(wrapped),
+		attrCipherETag: cipherETag,
+	}); err != nil {
+		return 0, "", err
+	}
+	return n, etag, nil
+}
+
+func (s *EncryptedStore) PutManifest(ctx context.Context, id ObjectID, r io.Reader) error {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := s.seal(pw, id, "manifest")
+		if err == nil {
+			_, err = io.Copy(w, r)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	err := s.inner.PutManifest(ctx, id, pr)
+	pr.Close()
+	<-done
+	return err
+}
+
+// Commit refuses blobs whose upload never got as far as recording the
+// plaintext attributes, e.g. because the process died in between.
+func (s *EncryptedStore) Commit(ctx context.Context, id ObjectID) (Meta, error) {
+	m, err := s.inner.StatBlob(ctx, id)
+	if err != nil {
+		return Meta{}, err
+	}
+	if m.State == StateUploaded {
+		if _, _, ok := s.plainAttrs(id, m); !ok {
+			return Meta{}, fmt.Errorf("%w: %s has no plaintext attributes", ErrBlobIncomplete, id)
+		}
+	}
+	m, err = s.inner.Commit(ctx, id)
+	return s.plainMeta(id, m), err
+}
+
+func (s *EncryptedStore) StatBlob(ctx context.Context, id ObjectID) (Meta, error) {
+	m, err := s.inner.StatBlob(ctx, id)
+	return s.plainMeta(id, m), err
+}
+
+func (s *EncryptedStore) RecordDownload(ctx context.Context, id ObjectID) (Meta, error) {
+	m, err := s.inner.RecordDownload(ctx, id)
+	return s.plainMeta(id, m), err
+}
+
+func (s *EncryptedStore) OpenBlob(ctx context.Context, id ObjectID) (Blob, error) {
+	m, err := s.inner.StatBlob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.inner.OpenBlob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.open(b, id, "blob", b.Info().Size)
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	info := b.Info()
+	pm := s.plainMeta(id, m)
+	info.Size, info.ETag = r.size, pm.ETag
+	return NewBlob(r, info), nil
+}
+
+func (s *EncryptedStore) GetManifest(ctx context.Context, id ObjectID) (io.ReadCloser, error) {
+	rc, err := s.inner.GetManifest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := s.open(rc, id, "manifest", -1)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// List, Usage and GroupUsage forward to the wrapped store when it supports
+// them. Usage counts ciphertext bytes, which is what occupies the disk.
+
+func (s *EncryptedStore) List(q Query, fn func(ObjectID, Meta) bool) error {
+	l, ok := s.inner.(Lister)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return l.List(q, func(id ObjectID, m Meta) bool { return fn(id, s.plainMeta(id, m)) })
+}
+
+func (s *EncryptedStore) Usage(ownerHash string) (owner, total Usage, err error) {
+	a, ok := s.inner.(Accountant)
+	if !ok {
+		return Usage{}, Usage{}, errors.ErrUnsupported
+	}
+	return a.Usage(ownerHash)
+}
+
+func (s *EncryptedStore) GroupUsage(room, client string) (r, c Usage, err error) {
+	a, ok := s.inner.(Accountant)
+	if !ok {
+		return Usage{}, Usage{}, errors.ErrUnsupported
+	}
+	return a.GroupUsage(room, client)
+}
+
+// plainAD binds wrapped plaintext attributes to the object and ciphertext.
+func plainAD(id ObjectID, cipherETag string) []byte {
+	return []byte("attrs:" + string(id) + ":" + cipherETag)
+}
+
+// plainAttrs unwraps the plaintext size and ETag of the blob m currently
+// holds, or reports false if none were recorded for it.
+func (s *EncryptedStore) plainAttrs(id ObjectID, m Meta) (int64, string, bool) {
+	if m.ETag == "" || m.Attrs[attrCipherETag] != m.ETag {
+		return 0, "", false
+	}
+	kid, enc, _ := strings.Cut(m.Attrs[attrPlain], ":")
+	wrapped, err := base64.RawStdEncoding.DecodeString(enc)
+	if err != nil {
+		return 0, "", false
+	}
+	p, err := s.keys.unwrap(kid, wrapped, plainAD(id, m.ETag))
+	if err != nil {
+		return 0, "", false
+	}
+	size, etag, _ := strings.Cut(string(p), " ")
+	n, err := strconv.ParseInt(size, 10, 64)
+	return n, etag, err == nil
+}
+
+// plainMeta replaces ciphertext Size and ETag with the plaintext ones and
+// hides the encryption attributes.
+func (s *EncryptedStore) plainMeta(id ObjectID, m Meta) Meta {
+	var ok bool
+	if m.Size, m.ETag, ok = s.plainAttrs(id, m); !ok {
+		m.Size, m.ETag = 0, "" // upload cut short before its attributes were recorded
+	}
+	var rest map[string]string
+	for k, v := range m.Attrs {
+		if !strings.HasPrefix(k, "enc.") {
+			if rest == nil {
+				rest = make(map[string]string)
+			}
+			rest[k] = v
+		}
+	}
+	m.Attrs = rest
+	return m
+}
+
+// seal writes the header for a fresh data key to w and returns the writer
+// for the plaintext; Close seals the final chunk.
+func (s *EncryptedStore) seal(w io.Writer, id ObjectID, kind string) (*sealWriter, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	kid, wrapped, err := s.keys.wrap(dek, nil)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	hdr := append([]byte(nil), encMagic...)
+	hdr = binary.BigEndian.AppendUint32(hdr, encChunk)
+	hdr = append(hdr, byte(len(kid)))
+	hdr = append(hdr, kid...)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(wrapped)))
+	hdr = append(hdr, wrapped...)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, c: chunker{aead: aead, ad: []byte(kind + ":" + string(id))}, buf: make([]byte, 0, encChunk)}, nil
+}
+
+// open reads the header from r and returns a reader for the plaintext. With
+// a known ciphertext size r must also be an io.Seeker and the result seeks.
+func (s *EncryptedStore) open(r io.ReadCloser, id ObjectID, kind string, cipherSize int64) (*openReader, error) {
+	fixed := make([]byte, len(encMagic)+4+1)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("encrypted %s %s: header: %w", kind, id, err)
+	}
+	if string(fixed[:4]) != string(encMagic) {
+		return nil, fmt.Errorf("encrypted %s %s: not encrypted with this format", kind, id)
+	}
+	cs := int64(binary.BigEndian.Uint32(fixed[4:]))
+	kid := make([]byte, fixed[8])
+	if _, err := io.ReadFull(r, kid); err != nil {
+		return nil, err
+	}
+	var wl [2]byte
+	if _, err := io.ReadFull(r, wl[:]); err != nil {
+		return nil, err
+	}
+	wrapped := make([]byte, binary.BigEndian.Uint16(wl[:]))
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, err
+	}
+	dek, err := s.keys.unwrap(string(kid), wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted %s %s: %w", kind, id, err)
+	}
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	hdrLen := int64(len(fixed)+len(kid)+2) + int64(len(wrapped))
+	o := &openReader{r: r, c: chunker{aead: aead, ad: []byte(kind + ":" + string(id))}, cs: cs, hdrLen: hdrLen, size: -1, at: hdrLen, loaded: -1}
+	if cipherSize >= 0 {
+		o.size = plainSize(cipherSize-hdrLen, cs, int64(aead.Overhead()))
+		if o.size < 0 {
+			return nil, fmt.Errorf("encrypted %s %s: truncated", kind, id)
+		}
+	}
+	return o, nil
+}
+
+// plainSize inverts the chunk framing: every chunk but the last is full, and
+// the last (possibly empty) one is always present.
+func plainSize(body, cs, overhead int64) int64 {
+	if body < overhead {
+		return -1
+	}
+	full := (body - overhead) / (cs + overhead)
+	return full*cs + body - overhead - full*(cs+overhead)
+}
+
+// chunker seals and opens single chunks; the nonce is the chunk index,
+// which is unique because every data key is used for one stream only.
+type chunker struct {
+	aead cipher.AEAD
+	ad   []byte
+}
+
+func (c chunker) params(idx int64, last bool) (nonce, ad []byte) {
+	nonce = make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(idx))
+	ad = binary.BigEndian.AppendUint64(append([]byte(nil), c.ad...), uint64(idx))
+	if last {
+		ad = append(ad, 1)
+	} else {
+		ad = append(ad, 0)
+	}
+	return nonce, ad
+}
+
+func (c chunker) seal(dst, p []byte, idx int64, last bool) []byte {
+	nonce, ad := c.params(idx, last)
+	return c.aead.Seal(dst, nonce, p, ad)
+}
+
+func (c chunker) open(dst, ct []byte, idx int64, last bool) ([]byte, error) {
+	nonce, ad := c.params(idx, last)
+	return c.aead.Open(dst, nonce, ct, ad)
+}
+
+type sealWriter struct {
+	w   io.Writer
+	c   chunker
+	buf []byte
+	idx int64
+	out []byte
+}
+
+func (w *sealWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data proves it is not last.
+		if len(w.buf) == encChunk {
+			if err := w.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		k := copy(w.buf[len(w.buf):encChunk], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (w *sealWriter) flush(last bool) error {
+	w.out = w.c.seal(w.out[:0], w.buf, w.idx, last)
+	w.idx++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+// Close seals the final chunk; it does not close the underlying writer.
+func (w *sealWriter) Close() error { return w.flush(true) }
+
+// openReader decrypts chunk by chunk. With a known size it supports Seek,
+// fetching only the chunks a read touches.
+type openReader struct {
+	r      io.ReadCloser
+	c      chunker
+	cs     int64
+	hdrLen int64
+	size   int64 // plaintext size, -1 when streaming
+
+	pos    int64 // plaintext offset of the next Read
+	at     int64 // ciphertext offset of r
+	loaded int64 // index of the chunk in plain, -1 for none
+	plain  []byte
+	last   bool // plain is the final chunk
+	ct     []byte
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	if o.size >= 0 && o.pos >= o.size {
+		return 0, io.EOF
+	}
+	idx := o.pos / o.cs
+	if idx != o.loaded {
+		if o.loaded >= 0 && o.last && o.size < 0 {
+			return 0, io.EOF
+		}
+		if err := o.load(idx); err != nil {
+			return 0, err
+		}
+	}
+	off := o.pos - idx*o.cs
+	if off >= int64(len(o.plain)) {
+		if o.last {
+			return 0, io.EOF
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, o.plain[off:])
+	o.pos += int64(n)
+	return n, nil
+}
+
+func (o *openReader) load(idx int64) error {
+	overhead := int64(o.c.aead.Overhead())
+	off := o.hdrLen + idx*(o.cs+overhead)
+	if off != o.at {
+		sk, ok := o.r.(io.Seeker)
+		if !ok {
+			return errors.New("encrypted stream: seek not supported")
+		}
+		if _, err := sk.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		o.at = off
+	}
+	want := o.cs + overhead
+	if o.size >= 0 {
+		want = min(want, o.size-idx*o.cs+overhead)
+	}
+	if int64(cap(o.ct)) < want {
+		o.ct = make([]byte, want)
+	}
+	ct := o.ct[:want]
+	n, err := io.ReadFull(o.r, ct)
+	o.at += int64(n)
+	if err != nil && !(o.size < 0 && errors.Is(err, io.ErrUnexpectedEOF)) {
+		return fmt.Errorf("encrypted stream: chunk %d: %w", idx, err)
+	}
+	ct = ct[:n]
+	// With a known size the last index follows from it; when streaming the
+	// chunk is tried both ways and only the final one opens as last.
+	var last bool
+	if o.size >= 0 {
+		last = idx == max(o.size-1, 0)/o.cs
+	}
+	plain, err := o.c.open(o.plain[:0], ct, idx, last)
+	if err != nil && o.size < 0 {
+		last = true
+		plain, err = o.c.open(o.plain[:0], ct, idx, true)
+	}
+	if err != nil {
+		return fmt.Errorf("encrypted stream: chunk %d: authentication failed", idx)
+	}
+	o.plain, o.loaded, o.last = plain, idx, last
+	return nil
+}
+
+func (o *openReader) Seek(offset int64, whence int) (int64, error) {
+	if o.size < 0 {
+		return 0, errors.New("encrypted stream: seek not supported")
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("encrypted stream: bad whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("encrypted stream: negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *openReader) Close() error { return o.r.Close() }
@@ -0,0 +1,203 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+	"github.com/collapsinghierarchy/noisytransfer/storage/storagetest"
+)
+
+// newKeyring writes a key file with the given key ids, the last active.
+func newKeyring(t *testing.T, ids ...string) *storage.Keyring {
+	var b strings.Builder
+	for _, id := range ids {
+		b.WriteString(keyLine(t, id))
+	}
+	return loadKeyring(t, b.String())
+}
+
+// keyLine is a key file line for a fresh random key.
+func keyLine(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+}
+
+func loadKeyring(t *testing.T, file string) *storage.Keyring {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := storage.LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func encrypted(t *testing.T, inner storage.Store) storage.Store {
+	s, err := storage.NewEncryptedStore(inner, newKeyring(t, "old", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEncryptedStore(t *testing.T) {
+	t.Run("FS", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Store { return encrypted(t, newFSStore(t)) })
+	})
+	t.Run("Mem", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Store { return encrypted(t, storage.NewMemStore(0, 0)) })
+	})
+	t.Run("S3", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Store { return encrypted(t, newS3Store(t)) })
+	})
+}
+
+func TestEncryptedStoreMetaHidesPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := storage.NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	s := encrypted(t, fs)
+	ctx := context.Background()
+	data := make([]byte, 100_003)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, etag, err := s.PutBlob(ctx, id, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if n != int64(len(data)) || etag != hex.EncodeToString(sum[:]) {
+		t.Fatalf("PutBlob = %d, %s; want the plaintext size and hash", n, etag)
+	}
+	if m, err := s.StatBlob(ctx, id); err != nil || m.Size != n || m.ETag != etag {
+		t.Fatalf("StatBlob = %+v, %v", m, err)
+	}
+
+	var metas int
+	err = filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.Name() != "meta.json" {
+			return err
+		}
+		metas++
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(raw, []byte(etag)) || bytes.Contains(raw, []byte("100003")) {
+			t.Errorf("%s holds the plaintext hash or size: %s", path, raw)
+		}
+		return nil
+	})
+	if err != nil || metas == 0 {
+		t.Fatalf("walk: %v, %d metas", err, metas)
+	}
+}
+
+// TestEncryptedStoreKeyRotation writes with one key, rotates to a new one
+// and checks that objects from both sides of the rotation read back, and
+// that retiring a key still in use fails loudly.
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	inner := newFSStore(t)
+	put := func(s storage.Store, data string) storage.ObjectID {
+		t.Helper()
+		id, err := s.Create(ctx, storage.CreateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := s.PutBlob(ctx, id, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutManifest(ctx, id, strings.NewReader(`{"of":"`+data+`"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Commit(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	readBack := func(s storage.Store, id storage.ObjectID) (blob, manifest string, err error) {
+		t.Helper()
+		b, err := s.OpenBlob(ctx, id)
+		if err != nil {
+			return "", "", err
+		}
+		defer b.Close()
+		bb, err := io.ReadAll(b)
+		if err != nil {
+			return "", "", err
+		}
+		rc, err := s.GetManifest(ctx, id)
+		if err != nil {
+			return "", "", err
+		}
+		defer rc.Close()
+		mb, err := io.ReadAll(rc)
+		return string(bb), string(mb), err
+	}
+
+	oldLine, newLine := keyLine(t, "old"), keyLine(t, "new")
+	before, err := storage.NewEncryptedStore(inner, loadKeyring(t, oldLine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := put(before, "before rotation")
+
+	rotated := loadKeyring(t, oldLine+newLine)
+	if rotated.Active() != "new" {
+		t.Fatalf("active key after appending: %q", rotated.Active())
+	}
+	after, err := storage.NewEncryptedStore(inner, rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID := put(after, "after rotation")
+	for id, want := range map[storage.ObjectID]string{oldID: "before rotation", newID: "after rotation"} {
+		blob, manifest, err := readBack(after, id)
+		if err != nil || blob != want || manifest != `{"of":"`+want+`"}` {
+			t.Fatalf("%s after rotation: %q, %q, %v", id, blob, manifest, err)
+		}
+		if m, err := after.StatBlob(ctx, id); err != nil || m.Size != int64(len(want)) {
+			t.Fatalf("StatBlob(%s) after rotation: %+v, %v", id, m, err)
+		}
+	}
+
+	retired, err := storage.NewEncryptedStore(inner, loadKeyring(t, newLine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := retired.OpenBlob(ctx, oldID); !errors.Is(err, storage.ErrUnknownKey) {
+		t.Fatalf("OpenBlob with its key removed: want ErrUnknownKey, got %v", err)
+	}
+	if _, err := retired.GetManifest(ctx, oldID); !errors.Is(err, storage.ErrUnknownKey) {
+		t.Fatalf("GetManifest with its key removed: want ErrUnknownKey, got %v", err)
+	}
+	if blob, _, err := readBack(retired, newID); err != nil || blob != "after rotation" {
+		t.Fatalf("object under the remaining key: %q, %v", blob, err)
+	}
+}
@@ -0,0 +1,5 @@
+package storage
+
+// Crash releases the store the way a dying process would: without the
+// clean-shutdown marker, so the next NewFSStore runs its recovery pass.
+func (s *FSStore) Crash() error { return s.index.Close() }
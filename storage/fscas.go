@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Content-addressed blob storage for FSStore.Dedup.
+//
+// A committed blob lives once at blobs/sha256/ab/cd/<sha256>, next to a
+// <sha256>.refs file holding the number of objects whose meta names it in
+// BlobRef. Identical ciphertext committed twice is therefore stored once.
+// Counts change only under FSStore.mu; GC removes content whose count has
+// dropped to zero, so a blob is never deleted while an object references it.
+
+func (s *FSStore) casPath(hash string) string {
+	if len(hash) < 4 {
+		return filepath.Join(s.Root, "blobs", "sha256", "_", hash)
+	}
+	return filepath.Join(s.Root, "blobs", "sha256", hash[0:2], hash[2:4], hash)
+}
+
+func (s *FSStore) casRefsPath(hash string) string { return s.casPath(hash) + ".refs" }
+
+// casAdopt moves the object's staged blob into content-addressed storage,
+// or drops it if identical content is already there. Called with s.mu held.
+func (s *FSStore) casAdopt(id ObjectID, m *Meta) error {
+	hash := m.ETag
+	p := s.casPath(hash)
+	switch _, err := os.Stat(p); {
+	case err == nil:
+		if err := os.Remove(s.blobTmp(id)); err != nil {
+			return err
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(s.blobTmp(id), p); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	if err := s.casAddRef(hash, 1); err != nil {
+		return err
+	}
+	m.BlobRef = hash
+	return nil
+}
+
+// casRelease drops one reference to hash. Called with s.mu held.
+func (s *FSStore) casRelease(hash string) error {
+	return s.casAddRef(hash, -1)
+}
+
+func (s *FSStore) casAddRef(hash string, delta int) error {
+	n, err := s.casRefs(hash)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	n += delta
+	if n < 0 {
+		n = 0
+	}
+	return writeJSON(s.casRefsPath(hash), n)
+}
+
+func (s *FSStore) casRefs(hash string) (int, error) {
+	b, err := os.ReadFile(s.casRefsPath(hash))
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if err := json.Unmarshal(b, &n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// casSweep removes content no object references any more.
+func (s *FSStore) casSweep() error {
+	root := filepath.Join(s.Root, "blobs", "sha256")
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || !strings.HasSuffix(name, ".refs") {
+			return nil
+		}
+		hash := strings.TrimSuffix(name, ".refs")
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if n, err := s.casRefs(hash); err != nil || n > 0 {
+			return nil
+		}
+		if err := os.Remove(s.casPath(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return os.Remove(p)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
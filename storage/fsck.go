@@ -0,0 +1,432 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FsckOptions controls a consistency check of an FSStore data directory.
+type FsckOptions struct {
+	Repair bool // fix what is found instead of only reporting it
+	Verify bool // re-hash blobs instead of only comparing sizes
+}
+
+// FsckIssue is one inconsistency found in the data directory.
+type FsckIssue struct {
+	Path    string
+	Problem string
+	Action  string // what was done, or would be done with Repair
+}
+
+func (i FsckIssue) String() string { return i.Path + ": " + i.Problem + " (" + i.Action + ")" }
+
+// FsckReport is the outcome of a check.
+type FsckReport struct {
+	Objects int
+	Issues  []FsckIssue
+}
+
+// Fsck checks the FSStore data directory at root and, with opts.Repair,
+// fixes it. The store must not be open in any other process.
+func Fsck(root string, opts FsckOptions) (FsckReport, error) {
+	s, err := openFSStore(root)
+	if err != nil {
+		return FsckReport{}, err
+	}
+	rep, err := s.fsck(opts)
+	if err == nil && opts.Repair {
+		err = s.index.end() // consistent now, whatever state it was left in
+	}
+	if cerr := s.index.Close(); err == nil {
+		err = cerr
+	}
+	return rep, err
+}
+
+// fsck walks every object directory and the content-addressed area. It
+// assumes no upload is streaming, so it only runs at startup or offline.
+//
+// Interrupted writes are resolved towards the last completed state: a
+// meta.json.tmp only wins when meta.json itself is missing or unreadable,
+// uploads are reset to created, interrupted commits are rolled back to
+// uploaded, and committed objects whose data is gone or corrupt become
+// expired tombstones. CAS reference counts are recounted from the metas and
+// the index is rebuilt after a repair.
+func (s *FSStore) fsck(opts FsckOptions) (FsckReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &fsckRun{s: s, opts: opts, now: time.Now().UTC(), refs: make(map[string]int), metas: make(map[ObjectID]Meta)}
+	if err := c.walkObjects(); err != nil {
+		return c.report, err
+	}
+	if err := c.checkCAS(); err != nil {
+		return c.report, err
+	}
+	c.report.Objects = len(c.metas)
+	if opts.Repair {
+		_, err := s.rebuildIndexLocked()
+		return c.report, err
+	}
+	return c.report, c.checkIndex()
+}
+
+type fsckRun struct {
+	s      *FSStore
+	opts   FsckOptions
+	now    time.Time
+	report FsckReport
+	refs   map[string]int // CAS hash → committed objects naming it
+	metas  map[ObjectID]Meta
+}
+
+func (c *fsckRun) issue(path, action, format string, args ...any) {
+	c.report.Issues = append(c.report.Issues, FsckIssue{Path: path, Problem: fmt.Sprintf(format, args...), Action: action})
+}
+
+// remove deletes path (file or directory) when repairing.
+func (c *fsckRun) remove(path string) error {
+	if !c.opts.Repair {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+func (c *fsckRun) walkObjects() error {
+	base := filepath.Join(c.s.Root, "objects")
+	walk := func(dir string, depth int) ([]os.DirEntry, error) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		var keep []os.DirEntry
+		for _, e := range entries {
+			ok := e.IsDir() && len(e.Name()) == 2
+			if depth == 2 {
+				_, err := ParseObjectID(e.Name())
+				ok = e.IsDir() && err == nil
+			}
+			if !ok {
+				p := filepath.Join(dir, e.Name())
+				c.issue(p, "remove", "unexpected entry in object tree")
+				if err := c.remove(p); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			keep = append(keep, e)
+		}
+		return keep, nil
+	}
+	l1, err := walk(base, 0)
+	if err != nil {
+		return err
+	}
+	for _, a := range l1 {
+		l2, err := walk(filepath.Join(base, a.Name()), 1)
+		if err != nil {
+			return err
+		}
+		for _, b := range l2 {
+			l3, err := walk(filepath.Join(base, a.Name(), b.Name()), 2)
+			if err != nil {
+				return err
+			}
+			for _, e := range l3 {
+				id := ObjectID(e.Name())
+				if p := filepath.Join(base, a.Name(), b.Name(), e.Name()); p != c.s.objDir(id) {
+					c.issue(p, "remove", "object in the wrong shard")
+					if err := c.remove(p); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := c.checkObject(id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fsckRun) checkObject(id ObjectID) error {
+	s := c.s
+	dir, metaP := s.objDir(id), s.metaPath(id)
+	m, err := s.readMeta(id)
+	if err != nil {
+		tm, terr := readMetaFile(metaP + ".tmp")
+		if terr != nil {
+			c.issue(dir, "remove object", "no readable meta.json: %v", err)
+			return c.remove(dir)
+		}
+		c.issue(metaP, "restore meta.json.tmp", "meta.json unreadable but a complete meta.json.tmp exists")
+		if c.opts.Repair {
+			if err := os.Rename(metaP+".tmp", metaP); err != nil {
+				return err
+			}
+		}
+		m = tm
+	} else if p := metaP + ".tmp"; exists(p) {
+		c.issue(p, "remove", "interrupted write")
+		if err := c.remove(p); err != nil {
+			return err
+		}
+	}
+	if p := s.manifestPath(id) + ".tmp"; exists(p) {
+		c.issue(p, "remove", "interrupted write")
+		if err := c.remove(p); err != nil {
+			return err
+		}
+	}
+
+	orig := m
+	var dirty bool
+	switch m.State {
+	case StateCreated:
+		c.dropStray(m, s.blobTmp(id), s.blobPath(id))
+	case StateUploading:
+		c.issue(dir, "reset to created", "upload was interrupted")
+		c.reset(id, &m)
+		dirty = true
+	case StateUploaded:
+		dirty = c.checkStaged(id, &m)
+	case StateCommitted:
+		dirty = c.checkCommitted(id, &m)
+	default: // tombstones
+		c.dropStray(m, s.blobTmp(id), s.blobPath(id), s.manifestPath(id))
+		if m.BlobRef != "" {
+			c.issue(metaP, "clear blob reference", "tombstone still references content %s", m.BlobRef)
+			m.BlobRef = ""
+			dirty = true
+		}
+	}
+	if m.State == StateCommitted && m.BlobRef != "" {
+		c.refs[m.BlobRef]++
+	}
+	if dirty && c.opts.Repair {
+		m.UpdatedAt = c.now
+		if err := writeJSON(metaP, m); err != nil {
+			return err
+		}
+	}
+	if !c.opts.Repair {
+		m = orig // report what the index should hold today
+	}
+	c.metas[id] = m
+	return nil
+}
+
+// dropStray removes data files a meta in this state should not have.
+func (c *fsckRun) dropStray(m Meta, paths ...string) {
+	for _, p := range paths {
+		if exists(p) {
+			c.issue(p, "remove", "file not expected for a %s object", m.State)
+			_ = c.remove(p)
+		}
+	}
+}
+
+// reset turns m back into a created object without a staged blob.
+func (c *fsckRun) reset(id ObjectID, m *Meta) {
+	_ = c.remove(c.s.blobTmp(id))
+	m.State, m.Size, m.ETag = StateCreated, 0, ""
+	m.scheduleExpiry(c.now)
+}
+
+// expire turns m into an expired tombstone and drops its data.
+func (c *fsckRun) expire(id ObjectID, m *Meta) {
+	for _, p := range []string{c.s.blobPath(id), c.s.blobTmp(id), c.s.manifestPath(id)} {
+		_ = c.remove(p)
+	}
+	m.State, m.Committed, m.BlobRef = StateExpired, false, ""
+}
+
+func (c *fsckRun) checkStaged(id ObjectID, m *Meta) bool {
+	s := c.s
+	tmp := s.blobTmp(id)
+	if !exists(tmp) {
+		// Commit moves the blob before writing meta; undo a half-done one.
+		var from string
+		switch {
+		case exists(s.blobPath(id)):
+			from = s.blobPath(id)
+		case m.ETag != "" && exists(s.casPath(m.ETag)):
+			from = s.casPath(m.ETag)
+		default:
+			c.issue(s.objDir(id), "reset to created", "uploaded object has no staged blob")
+			c.reset(id, m)
+			return true
+		}
+		c.issue(from, "restore as blob.tmp", "commit was interrupted")
+		if c.opts.Repair {
+			var err error
+			if from == s.blobPath(id) {
+				err = os.Rename(from, tmp)
+			} else {
+				err = os.Link(from, tmp)
+			}
+			if err != nil {
+				c.reset(id, m)
+				return true
+			}
+		} else {
+			tmp = from
+		}
+	}
+	if problem := c.verify(tmp, *m); problem != "" {
+		c.issue(tmp, "reset to created", "%s", problem)
+		c.reset(id, m)
+		return true
+	}
+	c.dropStray(*m, s.blobPath(id))
+	return false
+}
+
+func (c *fsckRun) checkCommitted(id ObjectID, m *Meta) bool {
+	s := c.s
+	p := s.blobPath(id)
+	if m.BlobRef != "" {
+		p = s.casPath(m.BlobRef)
+		c.dropStray(*m, s.blobPath(id))
+	}
+	c.dropStray(*m, s.blobTmp(id))
+	if !exists(s.manifestPath(id)) {
+		c.issue(s.objDir(id), "expire", "committed object has no manifest")
+		c.expire(id, m)
+		return true
+	}
+	if problem := c.verify(p, *m); problem != "" {
+		c.issue(p, "expire", "%s", problem)
+		c.expire(id, m)
+		return true
+	}
+	return false
+}
+
+// verify compares the blob at path with the size and ETag recorded in m and
+// describes any mismatch.
+func (c *fsckRun) verify(path string, m Meta) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "blob missing"
+	}
+	if fi.Size() != m.Size {
+		return fmt.Sprintf("blob is %d bytes, meta says %d", fi.Size(), m.Size)
+	}
+	if !c.opts.Verify {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err.Error()
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != m.ETag {
+		return "blob hash " + sum + " does not match etag " + m.ETag
+	}
+	return ""
+}
+
+// checkCAS recounts references to content-addressed blobs and drops content
+// nothing refers to.
+func (c *fsckRun) checkCAS() error {
+	root := filepath.Join(c.s.Root, "blobs", "sha256")
+	seen := make(map[string]bool)
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			c.issue(p, "remove", "interrupted write")
+			return c.remove(p)
+		case strings.HasSuffix(name, ".refs"):
+			seen[strings.TrimSuffix(name, ".refs")] = true
+		default:
+			seen[name] = true
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for hash := range c.refs {
+		seen[hash] = true
+	}
+	for hash := range seen {
+		want := c.refs[hash]
+		if want == 0 {
+			c.issue(c.s.casPath(hash), "remove", "content not referenced by any object")
+			if err := c.remove(c.s.casPath(hash)); err != nil {
+				return err
+			}
+			if err := c.remove(c.s.casRefsPath(hash)); err != nil {
+				return err
+			}
+			continue
+		}
+		if n, err := c.s.casRefs(hash); err != nil || n != want {
+			c.issue(c.s.casRefsPath(hash), "rewrite", "refcount %d, %d objects reference it", n, want)
+			if c.opts.Repair {
+				if err := writeJSON(c.s.casRefsPath(hash), want); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkIndex reports index entries that differ from the metas on disk.
+func (c *fsckRun) checkIndex() error {
+	var stale, found int
+	err := c.s.index.Query(Query{}, func(id ObjectID, m Meta) bool {
+		want, ok := c.metas[id]
+		if ok {
+			found++
+		}
+		if !ok || !sameMeta(m, want) {
+			stale++
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	stale += len(c.metas) - found // on disk but not indexed
+	if stale > 0 {
+		c.issue(filepath.Join(c.s.Root, "index.db"), "rebuild index", "%d entries out of date", stale)
+	}
+	return nil
+}
+
+func sameMeta(a, b Meta) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return bytes.Equal(ja, jb)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
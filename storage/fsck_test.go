@@ -0,0 +1,546 @@
+package storage_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+func mustCreate(t *testing.T, s *storage.FSStore) storage.ObjectID {
+	t.Helper()
+	id, err := s.Create(context.Background(), storage.CreateOptions{OwnerHash: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// mustStage leaves id uploaded with data and a manifest.
+func mustStage(t *testing.T, s *storage.FSStore, id storage.ObjectID, data string) {
+	t.Helper()
+	ctx := context.Background()
+	if _, _, err := s.PutBlob(ctx, id, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutManifest(ctx, id, strings.NewReader(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustCommit(t *testing.T, s *storage.FSStore, data string) storage.ObjectID {
+	t.Helper()
+	id := mustCreate(t, s)
+	mustStage(t, s, id, data)
+	if _, err := s.Commit(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func casPath(root, data string) string {
+	sum := sha256.Sum256([]byte(data))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(root, "blobs", "sha256", h[0:2], h[2:4], h)
+}
+
+// snapshot maps every path under root except the index to its content, so
+// a check-only run can be shown to change nothing.
+func snapshot(t *testing.T, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.Name() == "index.db" {
+			return err
+		}
+		var b []byte
+		if !d.IsDir() {
+			if b, err = os.ReadFile(p); err != nil {
+				return err
+			}
+		}
+		files[p] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// reopen opens the repaired store for the checks of a case.
+func reopen(t *testing.T, root string) *storage.FSStore {
+	t.Helper()
+	s, err := storage.NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if rec := s.Recovered(); len(rec) != 0 {
+		t.Errorf("recovery ran after a repairing fsck: %v", rec)
+	}
+	return s
+}
+
+func stat(t *testing.T, s *storage.FSStore, id storage.ObjectID) storage.Meta {
+	t.Helper()
+	m, err := s.StatBlob(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func read(t *testing.T, s *storage.FSStore, id storage.ObjectID) string {
+	t.Helper()
+	b, err := s.OpenBlob(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	data, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func gone(t *testing.T, path string) {
+	t.Helper()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s still there (stat: %v)", path, err)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		dedup  bool
+		hashed bool // only found when blobs are re-hashed (Verify)
+		// setup builds and corrupts a store, returning the object the
+		// checks look at.
+		setup   func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID
+		problem string // substring of the expected issue
+		action  string
+		check   func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID)
+	}{
+		{
+			name: "StrayMetaTmp",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				writeFile(t, filepath.Join(objDir(root, id), "meta.json.tmp"), []byte(`{"sta`))
+				return id
+			},
+			problem: "interrupted write", action: "remove",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				gone(t, filepath.Join(objDir(root, id), "meta.json.tmp"))
+				if got := read(t, s, id); got != "data" {
+					t.Fatalf("content: %q", got)
+				}
+			},
+		},
+		{
+			name: "MetaOnlyInTmp",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				p := filepath.Join(objDir(root, id), "meta.json")
+				if err := os.Rename(p, p+".tmp"); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			problem: "complete meta.json.tmp exists", action: "restore meta.json.tmp",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if got := read(t, s, id); got != "data" {
+					t.Fatalf("content: %q", got)
+				}
+			},
+		},
+		{
+			name: "NoMeta",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				writeFile(t, filepath.Join(objDir(root, id), "meta.json"), []byte("not json"))
+				return id
+			},
+			problem: "no readable meta.json", action: "remove object",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				gone(t, objDir(root, id))
+				if _, err := s.StatBlob(ctx, id); !errors.Is(err, os.ErrNotExist) {
+					t.Fatalf("StatBlob: want os.ErrNotExist, got %v", err)
+				}
+			},
+		},
+		{
+			name: "StrayEntry",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				writeFile(t, filepath.Join(root, "objects", "junk.txt"), []byte("x"))
+				return id
+			},
+			problem: "unexpected entry in object tree", action: "remove",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				gone(t, filepath.Join(root, "objects", "junk.txt"))
+				if got := read(t, s, id); got != "data" {
+					t.Fatalf("content: %q", got)
+				}
+			},
+		},
+		{
+			name: "InterruptedUpload",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCreate(t, s)
+				mustStage(t, s, id, "half")
+				p := filepath.Join(objDir(root, id), "meta.json")
+				m := readMetaFile(t, p)
+				m.State = storage.StateUploading
+				writeMetaFile(t, p, m)
+				return id
+			},
+			problem: "upload was interrupted", action: "reset to created",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateCreated || m.Size != 0 || m.ETag != "" {
+					t.Fatalf("state=%s size=%d etag=%q", m.State, m.Size, m.ETag)
+				}
+				gone(t, filepath.Join(objDir(root, id), "blob.tmp"))
+			},
+		},
+		{
+			name: "StagedBlobMissing",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCreate(t, s)
+				mustStage(t, s, id, "staged")
+				if err := os.Remove(filepath.Join(objDir(root, id), "blob.tmp")); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			problem: "uploaded object has no staged blob", action: "reset to created",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateCreated || m.Size != 0 {
+					t.Fatalf("state=%s size=%d", m.State, m.Size)
+				}
+			},
+		},
+		{
+			name: "StagedBlobCorrupt",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCreate(t, s)
+				mustStage(t, s, id, "staged")
+				writeFile(t, filepath.Join(objDir(root, id), "blob.tmp"), []byte("STAGED"))
+				return id
+			},
+			hashed:  true,
+			problem: "does not match etag", action: "reset to created",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateCreated {
+					t.Fatalf("state=%s", m.State)
+				}
+				gone(t, filepath.Join(objDir(root, id), "blob.tmp"))
+			},
+		},
+		{
+			name: "InterruptedCommit",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCreate(t, s)
+				mustStage(t, s, id, "staged")
+				dir := objDir(root, id)
+				if err := os.Rename(filepath.Join(dir, "blob.tmp"), filepath.Join(dir, "blob")); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			problem: "commit was interrupted", action: "restore as blob.tmp",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateUploaded {
+					t.Fatalf("state=%s", m.State)
+				}
+				if _, err := s.Commit(ctx, id); err != nil {
+					t.Fatal(err)
+				}
+				if got := read(t, s, id); got != "staged" {
+					t.Fatalf("content: %q", got)
+				}
+			},
+		},
+		{
+			// The content was already stored for another object, so the
+			// commit dropped blob.tmp; fsck links it back from the CAS.
+			name:  "InterruptedDedupCommit",
+			dedup: true,
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				mustCommit(t, s, "shared")
+				id := mustCreate(t, s)
+				mustStage(t, s, id, "shared")
+				if err := os.Remove(filepath.Join(objDir(root, id), "blob.tmp")); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			problem: "commit was interrupted", action: "restore as blob.tmp",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateUploaded {
+					t.Fatalf("state=%s", m.State)
+				}
+				if _, err := s.Commit(ctx, id); err != nil {
+					t.Fatal(err)
+				}
+				if got := read(t, s, id); got != "shared" {
+					t.Fatalf("content: %q", got)
+				}
+				refs, err := os.ReadFile(casPath(root, "shared") + ".refs")
+				if err != nil || strings.TrimSpace(string(refs)) != "2" {
+					t.Fatalf("refs = %q, %v; want 2", refs, err)
+				}
+			},
+		},
+		{
+			name: "CommittedNoManifest",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				if err := os.Remove(filepath.Join(objDir(root, id), "manifest.json")); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			problem: "committed object has no manifest", action: "expire",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateExpired {
+					t.Fatalf("state=%s", m.State)
+				}
+				gone(t, filepath.Join(objDir(root, id), "blob"))
+			},
+		},
+		{
+			name: "CommittedBlobTruncated",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				writeFile(t, filepath.Join(objDir(root, id), "blob"), []byte("da"))
+				return id
+			},
+			problem: "blob is 2 bytes, meta says 4", action: "expire",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateExpired {
+					t.Fatalf("state=%s", m.State)
+				}
+				gone(t, filepath.Join(objDir(root, id), "blob"))
+				gone(t, filepath.Join(objDir(root, id), "manifest.json"))
+			},
+		},
+		{
+			name: "CommittedBlobCorrupt",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				writeFile(t, filepath.Join(objDir(root, id), "blob"), []byte("DATA"))
+				return id
+			},
+			hashed:  true,
+			problem: "does not match etag", action: "expire",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				if m := stat(t, s, id); m.State != storage.StateExpired {
+					t.Fatalf("state=%s", m.State)
+				}
+				if _, total, err := s.Usage(""); err != nil || total.Bytes != 0 {
+					t.Fatalf("usage after expiry: %+v, %v", total, err)
+				}
+			},
+		},
+		{
+			name:  "CASMissing",
+			dedup: true,
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				if err := os.Remove(casPath(root, "data")); err != nil {
+					t.Fatal(err)
+				}
+				return id
+			},
+			problem: "blob missing", action: "expire",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				m := stat(t, s, id)
+				if m.State != storage.StateExpired || m.BlobRef != "" {
+					t.Fatalf("state=%s blobRef=%q", m.State, m.BlobRef)
+				}
+				gone(t, casPath(root, "data")+".refs")
+			},
+		},
+		{
+			name:  "CASRefcount",
+			dedup: true,
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				mustCommit(t, s, "data")
+				writeFile(t, casPath(root, "data")+".refs", []byte("7\n"))
+				return id
+			},
+			problem: "refcount 7, 2 objects reference it", action: "rewrite",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				refs, err := os.ReadFile(casPath(root, "data") + ".refs")
+				if err != nil || strings.TrimSpace(string(refs)) != "2" {
+					t.Fatalf("refs = %q, %v; want 2", refs, err)
+				}
+				if got := read(t, s, id); got != "data" {
+					t.Fatalf("content: %q", got)
+				}
+			},
+		},
+		{
+			name:  "CASUnreferenced",
+			dedup: true,
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "kept")
+				p := casPath(root, "orphan")
+				if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				writeFile(t, p, []byte("orphan"))
+				writeFile(t, p+".refs", []byte("1\n"))
+				return id
+			},
+			problem: "content not referenced by any object", action: "remove",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				gone(t, casPath(root, "orphan"))
+				gone(t, casPath(root, "orphan")+".refs")
+				if got := read(t, s, id); got != "kept" {
+					t.Fatalf("content: %q", got)
+				}
+			},
+		},
+		{
+			// Only a check-only run reports the index; a repair rebuilds
+			// it unconditionally.
+			name: "StaleIndex",
+			setup: func(t *testing.T, s *storage.FSStore, root string) storage.ObjectID {
+				id := mustCommit(t, s, "data")
+				p := filepath.Join(objDir(root, id), "meta.json")
+				m := readMetaFile(t, p)
+				m.Downloads = 5
+				writeMetaFile(t, p, m)
+				return id
+			},
+			problem: "1 entries out of date", action: "rebuild index",
+			check: func(t *testing.T, s *storage.FSStore, root string, id storage.ObjectID) {
+				var got storage.Meta
+				err := s.List(storage.Query{}, func(lid storage.ObjectID, m storage.Meta) bool {
+					if lid == id {
+						got = m
+					}
+					return true
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Downloads != 5 {
+					t.Fatalf("indexed downloads = %d, want 5", got.Downloads)
+				}
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			s, err := storage.NewFSStore(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Dedup = tc.dedup
+			id := tc.setup(t, s, root)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			run := func(opts storage.FsckOptions) []storage.FsckIssue {
+				t.Helper()
+				rep, err := storage.Fsck(root, opts)
+				if err != nil {
+					t.Fatalf("Fsck(%+v): %v", opts, err)
+				}
+				return rep.Issues
+			}
+			has := func(issues []storage.FsckIssue) bool {
+				for _, i := range issues {
+					if strings.Contains(i.Problem, tc.problem) && i.Action == tc.action {
+						return true
+					}
+				}
+				return false
+			}
+
+			before := snapshot(t, root)
+			if got := has(run(storage.FsckOptions{})); got == tc.hashed {
+				t.Errorf("check without Verify: reported=%v, want %v", got, !tc.hashed)
+			}
+			if issues := run(storage.FsckOptions{Verify: true}); !has(issues) {
+				t.Fatalf("check with Verify: want %q (%s), got %v", tc.problem, tc.action, issues)
+			}
+			if after := snapshot(t, root); !maps.Equal(before, after) {
+				t.Fatal("check-only runs modified the data directory")
+			}
+
+			issues := run(storage.FsckOptions{Repair: true, Verify: true})
+			if tc.action != "rebuild index" && !has(issues) {
+				t.Fatalf("repair: want %q (%s), got %v", tc.problem, tc.action, issues)
+			}
+			if issues := run(storage.FsckOptions{Verify: true}); len(issues) != 0 {
+				t.Fatalf("issues left after repair: %v", issues)
+			}
+			s = reopen(t, root)
+			s.Dedup = tc.dedup
+			tc.check(t, s, root, id)
+		})
+	}
+}
+
+// TestFSStoreRecoveryOnlyAfterCrash checks that NewFSStore repairs the
+// directory after an unclean shutdown, and leaves it alone after Close.
+func TestFSStoreRecoveryOnlyAfterCrash(t *testing.T) {
+	root := t.TempDir()
+	s, err := storage.NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := mustCommit(t, s, "data")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(objDir(root, id), "meta.json.tmp")
+	writeFile(t, stray, []byte(`{"sta`))
+
+	s, err = storage.NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := s.Recovered(); len(rec) != 0 {
+		t.Fatalf("recovery ran after a clean shutdown: %v", rec)
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Fatalf("stray file touched without recovery: %v", err)
+	}
+	if err := s.Crash(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = storage.NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	rec := s.Recovered()
+	if len(rec) != 1 || rec[0].Path != stray || rec[0].Action != "remove" {
+		t.Fatalf("Recovered after crash: %v", rec)
+	}
+	gone(t, stray)
+	if got := read(t, s, id); got != "data" {
+		t.Fatalf("content: %q", got)
+	}
+}
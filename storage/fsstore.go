@@ -2,64 +2,320 @@ package storage
 
 import (
 	"context"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 type Meta struct {
-	Size      int64     `json:"size"`
-	ETag      string    `json:"etag"`
-	CreatedAt time.Time `json:"createdAt"`
-	Committed bool      `json:"committed"`
+	Size        int64     `json:"size"`
+	ETag        string    `json:"etag"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	CommittedAt time.Time `json:"committedAt,omitzero"`
+	State       State     `json:"state"`
+	Committed   bool      `json:"committed"` // State == StateCommitted; kept for older clients
+	OwnerHash   string    `json:"ownerHash,omitempty"`
+	BlobRef     string    `json:"blobRef,omitempty"` // content address when stored deduplicated (FSStore.Dedup)
+	Room        string    `json:"room,omitempty"`    // hub room told about lifecycle events; opaque to the store
+	Client      string    `json:"client,omitempty"`  // digest of the creating client's address; opaque to the store
+
+	MaxDownloads int       `json:"maxDownloads,omitempty"` // 0 = unlimited
+	Downloads    int       `json:"downloads"`              // completed full-body downloads
+	ExpiresAt    time.Time `json:"expiresAt,omitzero"`     // effective expiry, see scheduleExpiry
+
+	UncommittedTTL time.Duration `json:"uncommittedTtl,omitempty"`
+	CommittedTTL   time.Duration `json:"committedTtl,omitempty"`
+	Deadline       time.Time     `json:"deadline,omitzero"` // hard cap on ExpiresAt
+
+	// Attrs are kept for wrapping stores (see EncryptedStore) and never
+	// interpreted by the store itself.
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// CreateOptions carries the per-object settings chosen at create time.
+type CreateOptions struct {
+	// OwnerHash is an opaque digest of the owner credential, stored so the
+	// caller can later authorize owner-only operations such as Delete.
+	OwnerHash string
+	// MaxDownloads expires the object after that many completed downloads
+	// (see RecordDownload). Zero means unlimited.
+	MaxDownloads int
+	// ExpiresAt expires the object at a fixed time whatever its state.
+	// Zero means no fixed deadline.
+	ExpiresAt time.Time
+	// UncommittedTTL bounds how long an object may sit idle before commit;
+	// every upload restarts the clock. CommittedTTL is its lifetime after
+	// commit. Zero disables the respective limit.
+	UncommittedTTL time.Duration
+	CommittedTTL   time.Duration
+	// Room links the object to a hub room (appID) whose peers are sent
+	// its lifecycle events. The store only records it.
+	Room string
+	// Client is an opaque digest of the address the object was created
+	// from, recorded so usage can be counted per client.
+	Client string
 }
 
 type Store interface {
-	Create(ctx context.Context) (string, error)
-	PutBlob(ctx context.Context, id string, r io.Reader) (int64, string, error)
-	PutManifest(ctx context.Context, id string, r io.Reader) error
-	Commit(ctx context.Context, id string) (Meta, error)
-	StatBlob(ctx context.Context, id string) (Meta, error)
-	OpenFile(ctx context.Context, id string) (*os.File, error)
-	GetManifest(ctx context.Context, id string) (io.ReadCloser, error)
-	Delete(ctx context.Context, id string) error
+	Create(ctx context.Context, opts CreateOptions) (ObjectID, error)
+	PutBlob(ctx context.Context, id ObjectID, r io.Reader) (int64, string, error)
+	PutManifest(ctx context.Context, id ObjectID, r io.Reader) error
+	Commit(ctx context.Context, id ObjectID) (Meta, error)
+	StatBlob(ctx context.Context, id ObjectID) (Meta, error)
+	OpenBlob(ctx context.Context, id ObjectID) (Blob, error)
+	GetManifest(ctx context.Context, id ObjectID) (io.ReadCloser, error)
+	RecordDownload(ctx context.Context, id ObjectID) (Meta, error)
+	Delete(ctx context.Context, id ObjectID) error
 	GC(ctx context.Context, ttl time.Duration) error
 }
 
-type FSStore struct{ Root string }
+// FSStore keeps objects under Root:
+//
+//	objects/ab/cd/<id>/meta.json, manifest.json, blob.tmp, blob
+//	blobs/sha256/ab/cd/<sha256>{,.refs}   (only with Dedup)
+//	index.db                              (see Index)
+//
+// Object directories are sharded by the first two byte pairs of the id so
+// no directory grows past 65536 entries per level. Every meta.json write is
+// mirrored into the index, which GC and List query instead of the tree.
+type FSStore struct {
+	Root string
+	// Dedup stores committed blobs once per distinct content (see fscas.go)
+	// instead of inside each object directory.
+	Dedup bool
+
+	index     *Index
+	recovered []FsckIssue
+	mu        sync.Mutex            // serializes meta read-modify-write (state transitions)
+	active    map[ObjectID]struct{} // ids with a PutBlob streaming in this process
+}
 
+// NewFSStore opens the store at root. If the previous process did not Close
+// it (a crash), a repairing fsck pass runs first; see Recovered.
 func NewFSStore(root string) (*FSStore, error) {
+	s, err := openFSStore(root)
+	if err != nil {
+		return nil, err
+	}
+	clean, err := s.index.begin()
+	if err == nil && (!clean || !s.index.Built()) {
+		var rep FsckReport
+		rep, err = s.fsck(FsckOptions{Repair: true})
+		s.recovered = rep.Issues
+	}
+	if err != nil {
+		_ = s.index.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func openFSStore(root string) (*FSStore, error) {
 	if err := os.MkdirAll(filepath.Join(root, "objects"), 0o755); err != nil {
 		return nil, err
 	}
-	return &FSStore{Root: root}, nil
+	s := &FSStore{Root: root}
+	if err := s.migrateFlat(); err != nil {
+		return nil, err
+	}
+	idx, err := OpenIndex(filepath.Join(root, "index.db"))
+	if err != nil {
+		return nil, err
+	}
+	s.index = idx
+	return s, nil
+}
+
+// Recovered returns what the startup recovery pass repaired, if it ran.
+func (s *FSStore) Recovered() []FsckIssue { return s.recovered }
+
+// Close marks the store cleanly shut down and releases the index. The store
+// must not be used afterwards.
+func (s *FSStore) Close() error {
+	if err := s.index.end(); err != nil {
+		_ = s.index.Close()
+		return err
+	}
+	return s.index.Close()
+}
+
+// RebuildIndex discards the index and rebuilds it from the meta.json files,
+// returning the number of objects indexed. Unreadable metas are skipped.
+func (s *FSStore) RebuildIndex() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebuildIndexLocked()
+}
+
+func (s *FSStore) rebuildIndexLocked() (int, error) {
+	metas := make(map[ObjectID]Meta)
+	err := s.forEachID(func(id ObjectID) {
+		if m, err := s.readMeta(id); err == nil {
+			metas[id] = m
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(metas), s.index.Rebuild(metas)
+}
+
+// SetAttrs merges attrs into the object's Attrs before commit.
+func (s *FSStore) SetAttrs(ctx context.Context, id ObjectID, attrs map[string]string) (Meta, error) {
+	return s.update(id, func(m *Meta) error { return m.setAttrs(id, attrs) })
+}
+
+// Usage reads the counters kept by the index.
+func (s *FSStore) Usage(ownerHash string) (owner, total Usage, err error) {
+	return s.index.Usage(ownerHash)
+}
+
+// GroupUsage reads the counters kept by the index.
+func (s *FSStore) GroupUsage(room, client string) (r, c Usage, err error) {
+	return s.index.GroupUsage(room, client)
 }
 
-func (s *FSStore) objDir(id string) string       { return filepath.Join(s.Root, "objects", id) }
-func (s *FSStore) blobTmp(id string) string      { return filepath.Join(s.objDir(id), "blob.tmp") }
-func (s *FSStore) blobPath(id string) string     { return filepath.Join(s.objDir(id), "blob") }
-func (s *FSStore) manifestPath(id string) string { return filepath.Join(s.objDir(id), "manifest.json") }
-func (s *FSStore) metaPath(id string) string     { return filepath.Join(s.objDir(id), "meta.json") }
+// List queries the index.
+func (s *FSStore) List(q Query, fn func(ObjectID, Meta) bool) error {
+	return s.index.Query(q, fn)
+}
 
-func (s *FSStore) Create(ctx context.Context) (string, error) {
-	id := uuidLike()
+// migrateFlat moves object directories of the old flat layout
+// (objects/<id>) into their shard.
+func (s *FSStore) migrateFlat() error {
+	base := filepath.Join(s.Root, "objects")
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, err := ParseObjectID(e.Name())
+		if err != nil || !e.IsDir() {
+			continue // shard directories and strays
+		}
+		dst := s.objDir(id)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(base, e.Name()), dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachID calls fn for every object directory in the sharded layout.
+func (s *FSStore) forEachID(fn func(ObjectID)) error {
+	base := filepath.Join(s.Root, "objects")
+	l1, err := os.ReadDir(base)
+	if err != nil {
+		return err
+	}
+	for _, a := range l1 {
+		if !a.IsDir() || len(a.Name()) != 2 {
+			continue
+		}
+		l2, err := os.ReadDir(filepath.Join(base, a.Name()))
+		if err != nil {
+			return err
+		}
+		for _, b := range l2 {
+			if !b.IsDir() || len(b.Name()) != 2 {
+				continue
+			}
+			l3, err := os.ReadDir(filepath.Join(base, a.Name(), b.Name()))
+			if err != nil {
+				return err
+			}
+			for _, e := range l3 {
+				if id, err := ParseObjectID(e.Name()); err == nil && e.IsDir() {
+					fn(id)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *FSStore) objDir(id ObjectID) string {
+	if len(id) < 4 { // only reachable with ids that failed checkID
+		return filepath.Join(s.Root, "objects", "_", string(id))
+	}
+	return filepath.Join(s.Root, "objects", string(id[0:2]), string(id[2:4]), string(id))
+}
+func (s *FSStore) blobTmp(id ObjectID) string  { return filepath.Join(s.objDir(id), "blob.tmp") }
+func (s *FSStore) blobPath(id ObjectID) string { return filepath.Join(s.objDir(id), "blob") }
+func (s *FSStore) manifestPath(id ObjectID) string {
+	return filepath.Join(s.objDir(id), "manifest.json")
+}
+func (s *FSStore) metaPath(id ObjectID) string { return filepath.Join(s.objDir(id), "meta.json") }
+
+func (s *FSStore) Create(ctx context.Context, opts CreateOptions) (ObjectID, error) {
+	id := NewObjectID()
 	if err := os.MkdirAll(s.objDir(id), 0o755); err != nil {
 		return "", err
 	}
-	m := Meta{Size: 0, ETag: "", CreatedAt: time.Now().UTC(), Committed: false}
-	if err := writeJSON(s.metaPath(id), m); err != nil {
+	m := newMeta(opts, time.Now().UTC())
+	if err := s.writeMeta(id, m); err != nil {
 		return "", err
 	}
 	return id, nil
 }
 
-func (s *FSStore) PutBlob(ctx context.Context, id string, r io.Reader) (int64, string, error) {
+// PutBlob streams r into the staging blob. Only one upload may run per object
+// and only before commit; a failed upload returns the object to created.
+// Uploading objects never expire, however long the stream takes.
+func (s *FSStore) PutBlob(ctx context.Context, id ObjectID, r io.Reader) (int64, string, error) {
+	if _, err := s.update(id, func(m *Meta) error {
+		if err := m.transition(id, "upload", StateUploading); err != nil {
+			return err
+		}
+		m.Size, m.ETag = 0, "" // a re-upload replaces the staged blob
+		s.setActive(id, true)
+		return nil
+	}); err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		s.mu.Lock()
+		s.setActive(id, false)
+		s.mu.Unlock()
+	}()
+
+	n, etag, err := s.writeBlob(id, r)
+	if err == nil {
+		_, err = s.update(id, func(m *Meta) error {
+			if err := m.transition(id, "upload", StateUploaded); err != nil {
+				return err // deleted or expired while streaming
+			}
+			m.Size, m.ETag = n, etag
+			m.scheduleExpiry(time.Now())
+			return nil
+		})
+	}
+	if err != nil {
+		_ = os.Remove(s.blobTmp(id))
+		_, _ = s.update(id, func(m *Meta) error {
+			m.Size, m.ETag = 0, ""
+			if err := m.transition(id, "upload", StateCreated); err != nil {
+				return err
+			}
+			m.scheduleExpiry(time.Now())
+			return nil
+		})
+		return 0, "", err
+	}
+	return n, etag, nil
+}
+
+func (s *FSStore) writeBlob(id ObjectID, r io.Reader) (int64, string, error) {
 	f, err := os.Create(s.blobTmp(id))
 	if err != nil {
 		return 0, "", err
@@ -75,110 +331,287 @@ func (s *FSStore) PutBlob(ctx context.Context, id string, r io.Reader) (int64, s
 	if err := f.Sync(); err != nil {
 		return 0, "", err
 	}
-	etag := hex.EncodeToString(h.Sum(nil))
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	m, err := s.readMeta(id)
+func (s *FSStore) PutManifest(ctx context.Context, id ObjectID, r io.Reader) error {
+	m, err := s.current(id)
 	if err != nil {
-		return 0, "", err
+		return err
 	}
-	m.Size = n
-	m.ETag = etag
-	if err := writeJSON(s.metaPath(id), m); err != nil {
-		return 0, "", err
+	if err := m.requireMutable(id, "put manifest"); err != nil {
+		return err
 	}
-	return n, etag, nil
-}
-
-func (s *FSStore) PutManifest(ctx context.Context, id string, r io.Reader) error {
-	f, err := os.Create(s.manifestPath(id))
+	tmp := s.manifestPath(id) + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	if _, err := io.Copy(f, r); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = os.Remove(tmp)
 		return err
 	}
-	return f.Sync()
-}
 
-func (s *FSStore) Commit(ctx context.Context, id string) (Meta, error) {
-	m, err := s.readMeta(id)
+	// Re-check under the lock: a commit may have raced the copy.
+	_, err = s.update(id, func(m *Meta) error {
+		if err := m.requireMutable(id, "put manifest"); err != nil {
+			return err
+		}
+		return os.Rename(tmp, s.manifestPath(id))
+	})
 	if err != nil {
-		return Meta{}, err
+		_ = os.Remove(tmp)
 	}
-	if _, err := os.Stat(s.blobTmp(id)); err != nil {
-		return Meta{}, err
+	return err
+}
+
+// Commit publishes the staged blob. It requires an uploaded blob and a manifest.
+func (s *FSStore) Commit(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.update(id, func(m *Meta) error {
+		if m.State == StateUploaded {
+			if _, err := os.Stat(s.manifestPath(id)); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return ErrManifestMissing
+				}
+				return err
+			}
+		}
+		if err := m.transition(id, "commit", StateCommitted); err != nil {
+			return err
+		}
+		m.CommittedAt = time.Now().UTC()
+		m.scheduleExpiry(m.CommittedAt)
+		if s.Dedup {
+			return s.casAdopt(id, m)
+		}
+		return os.Rename(s.blobTmp(id), s.blobPath(id))
+	})
+}
+
+// StatBlob returns the object's metadata; callers check State before serving.
+func (s *FSStore) StatBlob(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.current(id)
+}
+
+func (s *FSStore) OpenBlob(ctx context.Context, id ObjectID) (Blob, error) {
+	m, err := s.current(id)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := os.Stat(s.manifestPath(id)); err != nil {
-		return Meta{}, err
+	if m.State != StateCommitted {
+		return nil, &StateError{ID: id, State: m.State, Op: "read blob"}
 	}
-	if err := os.Rename(s.blobTmp(id), s.blobPath(id)); err != nil {
-		return Meta{}, err
+	p := s.blobPath(id)
+	if m.BlobRef != "" {
+		p = s.casPath(m.BlobRef)
 	}
-	m.Committed = true
-	if err := writeJSON(s.metaPath(id), m); err != nil {
-		return Meta{}, err
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
 	}
-	return m, nil
+	return NewBlob(f, blobInfo(m)), nil
 }
 
-func (s *FSStore) StatBlob(ctx context.Context, id string) (Meta, error) {
-	m, err := s.readMeta(id)
+func (s *FSStore) GetManifest(ctx context.Context, id ObjectID) (io.ReadCloser, error) {
+	m, err := s.current(id)
 	if err != nil {
-		return Meta{}, err
-	}
-	// Committed blob present?
-	if _, err := os.Stat(s.blobPath(id)); err == nil {
-		return m, nil
+		return nil, err
 	}
-	// Pre-commit temp blob present? Report meta so caller can return 409.
-	if _, err := os.Stat(s.blobTmp(id)); err == nil {
-		return m, nil
+	if m.State.Terminal() {
+		return nil, &StateError{ID: id, State: m.State, Op: "get manifest"}
 	}
-	// Neither committed nor temp blob found.
-	return Meta{}, os.ErrNotExist
+	return os.Open(s.manifestPath(id))
 }
 
-func (s *FSStore) OpenFile(ctx context.Context, id string) (*os.File, error) {
-	return os.Open(s.blobPath(id))
+// Delete revokes the object: its blob and manifest are removed and a
+// tombstone meta is kept until GC so later reads can tell "gone" from
+// "never existed".
+func (s *FSStore) Delete(ctx context.Context, id ObjectID) error {
+	_, err := s.update(id, func(m *Meta) error {
+		if err := m.transition(id, "delete", StateDeleted); err != nil {
+			return err
+		}
+		return s.removeData(id, m)
+	})
+	return err
 }
 
-func (s *FSStore) GetManifest(ctx context.Context, id string) (io.ReadCloser, error) {
-	return os.Open(s.manifestPath(id))
+// RecordDownload counts one completed download of a committed object and
+// expires it once MaxDownloads is reached. Readers that already opened the
+// blob finish normally.
+func (s *FSStore) RecordDownload(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.update(id, func(m *Meta) error {
+		if m.State != StateCommitted {
+			return &StateError{ID: id, State: m.State, Op: "download"}
+		}
+		m.Downloads++
+		if m.MaxDownloads > 0 && m.Downloads >= m.MaxDownloads {
+			if err := m.transition(id, "download", StateExpired); err != nil {
+				return err
+			}
+			return s.removeData(id, m)
+		}
+		return nil
+	})
 }
 
-func (s *FSStore) Delete(ctx context.Context, id string) error {
-	return os.RemoveAll(s.objDir(id))
+// removeData drops blob and manifest files, leaving meta as a tombstone.
+// A deduplicated blob loses this object's reference. Called with s.mu held.
+func (s *FSStore) removeData(id ObjectID, m *Meta) error {
+	if m.BlobRef != "" {
+		if err := s.casRelease(m.BlobRef); err != nil {
+			return err
+		}
+		m.BlobRef = ""
+	}
+	for _, p := range []string{s.blobPath(id), s.blobTmp(id), s.manifestPath(id)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// setActive must be called with s.mu held.
+func (s *FSStore) setActive(id ObjectID, on bool) {
+	if s.active == nil {
+		s.active = make(map[ObjectID]struct{})
+	}
+	if on {
+		s.active[id] = struct{}{}
+	} else {
+		delete(s.active, id)
+	}
+}
+
+// purge removes every trace of the object, tombstone included.
+func (s *FSStore) purge(id ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, err := s.readMeta(id); err == nil && m.BlobRef != "" {
+		if err := s.casRelease(m.BlobRef); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(s.objDir(id)); err != nil {
+		return err
+	}
+	return s.index.Delete(id)
 }
 
+// GC tombstones objects past their ExpiresAt and purges tombstones once they
+// are older than ttl. Objects without any expiry fall back to being purged
+// ttl after creation. Uploads left "uploading" by a dead process are reset to
+// created so their uncommitted TTL applies again. Candidates come from the
+// index; only their meta.json files are read. With Dedup, content no object
+// references any more is removed last.
 func (s *FSStore) GC(ctx context.Context, ttl time.Duration) error {
-	base := filepath.Join(s.Root, "objects")
-	entries, err := os.ReadDir(base)
+	now := time.Now()
+	ids, err := s.index.gcCandidates(now, ttl)
 	if err != nil {
 		return err
 	}
-	now := time.Now()
-	for _, e := range entries {
-		if !e.IsDir() {
+	for _, id := range ids {
+		m, err := s.readMeta(id)
+		if errors.Is(err, os.ErrNotExist) {
+			_ = s.index.Delete(id) // removed behind our back
 			continue
 		}
-		id := e.Name()
-		m, err := s.readMeta(id)
 		if err != nil {
-			_ = s.Delete(ctx, id)
-			continue
+			continue // unreadable; left for fsck to report
 		}
-		if now.Sub(m.CreatedAt) >= ttl {
-			_ = s.Delete(ctx, id)
+		switch gcDecide(m, now, ttl) {
+		case gcPurge:
+			_ = s.purge(id)
+		case gcResetUpload:
+			s.resetStaleUpload(id)
+		case gcExpire:
+			_, _ = s.current(id)
 		}
 	}
-	return nil
+	return s.casSweep()
+}
+
+func (s *FSStore) resetStaleUpload(id ObjectID) {
+	s.mu.Lock()
+	_, live := s.active[id]
+	s.mu.Unlock()
+	if live {
+		return
+	}
+	_, _ = s.update(id, func(m *Meta) error {
+		if _, live := s.active[id]; live {
+			return nil // an upload started since we looked
+		}
+		if err := m.transition(id, "reset", StateCreated); err != nil {
+			return err
+		}
+		m.Size, m.ETag = 0, ""
+		m.scheduleExpiry(time.Now())
+		return os.Remove(s.blobTmp(id))
+	})
 }
 
 // helpers
 
-func (s *FSStore) readMeta(id string) (Meta, error) {
-	f, err := os.Open(s.metaPath(id))
+// update applies fn to the object's meta under the store lock and persists the
+// result. Nothing is written when fn fails.
+func (s *FSStore) update(id ObjectID, fn func(*Meta) error) (Meta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, err := s.readMeta(id)
+	if err != nil {
+		return Meta{}, err
+	}
+	now := time.Now().UTC()
+	if m.Expired(now) {
+		// Tombstone first; fn then sees StateExpired and refuses.
+		if err := m.transition(id, "expire", StateExpired); err != nil {
+			return Meta{}, err
+		}
+		if err := s.removeData(id, &m); err != nil {
+			return Meta{}, err
+		}
+		m.UpdatedAt = now
+		if err := s.writeMeta(id, m); err != nil {
+			return Meta{}, err
+		}
+	}
+	if err := fn(&m); err != nil {
+		return Meta{}, err
+	}
+	m.UpdatedAt = now
+	if err := s.writeMeta(id, m); err != nil {
+		return Meta{}, err
+	}
+	return m, nil
+}
+
+// current reads the object's meta, expiring it first if its time is up.
+func (s *FSStore) current(id ObjectID) (Meta, error) {
+	m, err := s.readMeta(id)
+	if err != nil || !m.Expired(time.Now()) {
+		return m, err
+	}
+	return s.update(id, func(*Meta) error { return nil })
+}
+
+// readMeta is the first storage access of every public method, so it is
+// where untrusted ids are rejected before any path is built from them.
+func (s *FSStore) readMeta(id ObjectID) (Meta, error) {
+	if err := checkID(id); err != nil {
+		return Meta{}, err
+	}
+	return readMetaFile(s.metaPath(id))
+}
+
+func readMetaFile(path string) (Meta, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return Meta{}, err
 	}
@@ -187,9 +620,27 @@ func (s *FSStore) readMeta(id string) (Meta, error) {
 	if err := json.NewDecoder(f).Decode(&m); err != nil {
 		return Meta{}, err
 	}
+	if m.State == "" { // written before states existed
+		switch {
+		case m.Committed:
+			m.State = StateCommitted
+		case m.ETag != "":
+			m.State = StateUploaded
+		default:
+			m.State = StateCreated
+		}
+	}
 	return m, nil
 }
 
+// writeMeta persists m and mirrors it into the index.
+func (s *FSStore) writeMeta(id ObjectID, m Meta) error {
+	if err := writeJSON(s.metaPath(id), m); err != nil {
+		return err
+	}
+	return s.index.Put(id, m)
+}
+
 func writeJSON(path string, v any) error {
 	tmp := path + ".tmp"
 	f, err := os.Create(tmp)
@@ -211,11 +662,3 @@ func writeJSON(path string, v any) error {
 	}
 	return os.Rename(tmp, path)
 }
-
-func uuidLike() string {
-	b := make([]byte, 16)
-	_, _ = rand.Read(b)
-	b[6] = (b[6] & 0x0f) | 0x40
-	b[8] = (b[8] & 0x3f) | 0x80
-	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
-}
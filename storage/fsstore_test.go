@@ -0,0 +1,149 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+	"github.com/collapsinghierarchy/noisytransfer/storage/storagetest"
+)
+
+func newFSStore(t *testing.T) *storage.FSStore {
+	s, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestFSStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store { return newFSStore(t) })
+}
+
+func TestFSStoreDedup(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		s := newFSStore(t)
+		s.Dedup = true
+		return s
+	})
+}
+
+// objDir is where FSStore keeps id under root.
+func objDir(root string, id storage.ObjectID) string {
+	return filepath.Join(root, "objects", string(id[0:2]), string(id[2:4]), string(id))
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeMetaFile(t *testing.T, path string, m storage.Meta) {
+	t.Helper()
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, b)
+}
+
+func readMetaFile(t *testing.T, path string) storage.Meta {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m storage.Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// TestFSStoreCrashRecovery leaves what a process killed mid-upload leaves
+// behind and checks that reopening the store cleans it up.
+func TestFSStoreCrashRecovery(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := storage.NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Create(ctx, storage.CreateOptions{OwnerHash: "owner"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.PutBlob(ctx, id, strings.NewReader("staged earlier")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Crash(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dead process had started a second upload: meta.json says
+	// uploading, blob.tmp is half written and so are the meta and manifest
+	// temp files.
+	dir := objDir(root, id)
+	m := readMetaFile(t, filepath.Join(dir, "meta.json"))
+	m.State, m.Size, m.ETag = storage.StateUploading, 1<<20, ""
+	writeMetaFile(t, filepath.Join(dir, "meta.json"), m)
+	writeFile(t, filepath.Join(dir, "blob.tmp"), bytes.Repeat([]byte("x"), 4096))
+	writeFile(t, filepath.Join(dir, "meta.json.tmp"), []byte(`{"state":"uplo`))
+	writeFile(t, filepath.Join(dir, "manifest.json.tmp"), []byte(`{"chunks":[`))
+
+	s, err = storage.NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(s.Recovered()) == 0 {
+		t.Error("Recovered: want the repairs listed, got none")
+	}
+	for _, name := range []string{"blob.tmp", "meta.json.tmp", "manifest.json.tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind (stat: %v)", name, err)
+		}
+	}
+	m, err = s.StatBlob(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.State != storage.StateCreated || m.Size != 0 || m.ETag != "" {
+		t.Fatalf("after recovery: state=%s size=%d etag=%q", m.State, m.Size, m.ETag)
+	}
+	owner, total, err := s.Usage("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner.Bytes != 0 || total.Bytes != 0 || total.Objects != 1 {
+		t.Fatalf("usage after recovery: owner=%+v total=%+v", owner, total)
+	}
+
+	if _, _, err := s.PutBlob(ctx, id, strings.NewReader("retry")); err != nil {
+		t.Fatalf("PutBlob after recovery: %v", err)
+	}
+	if err := s.PutManifest(ctx, id, strings.NewReader(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Commit(ctx, id); err != nil {
+		t.Fatalf("Commit after recovery: %v", err)
+	}
+	b, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if got, _ := io.ReadAll(b); string(got) != "retry" {
+		t.Fatalf("content after recovery: %q", got)
+	}
+}
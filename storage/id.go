@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// ObjectID names an object. The only valid form is the canonical lowercase
+// UUID text (8-4-4-4-12 hex digits), which can never contain a path
+// separator or dot segment, so stores may use it verbatim in paths and keys.
+type ObjectID string
+
+// ErrInvalidID is returned for ids that are not canonical ObjectIDs.
+var ErrInvalidID = errors.New("invalid object id")
+
+// NewObjectID returns a random (version 4) ObjectID.
+func NewObjectID() ObjectID {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return ObjectID(fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+}
+
+// ParseObjectID validates s as an ObjectID.
+func ParseObjectID(s string) (ObjectID, error) {
+	id := ObjectID(s)
+	if !id.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrInvalidID, s)
+	}
+	return id, nil
+}
+
+// Valid reports whether id is in canonical form. Stores check it on every
+// call because a conversion like ObjectID(s) bypasses ParseObjectID.
+func (id ObjectID) Valid() bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (id ObjectID) String() string { return string(id) }
+
+// checkID is the guard every Store method runs before touching storage.
+func checkID(id ObjectID) error {
+	if !id.Valid() {
+		return fmt.Errorf("%w: %q", ErrInvalidID, string(id))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+// FuzzParseObjectID feeds raw strings to FSStore's entry points, bypassing
+// ParseObjectID as a conversion would: each call must either reject the id
+// with ErrInvalidID or leave everything outside root/objects untouched.
+func FuzzParseObjectID(f *testing.F) {
+	base := f.TempDir()
+	root := filepath.Join(base, "store")
+	s, err := storage.NewFSStore(root)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { s.Close() })
+	ctx := context.Background()
+	id, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		f.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "canary"), []byte("x"), 0o644); err != nil {
+		f.Fatal(err)
+	}
+
+	for _, seed := range []string{
+		string(id),
+		string(storage.NewObjectID()),
+		"",
+		"../x",
+		"ab/../..",
+		"../../canary",
+		"00000000-0000-4000-8000-000000000000",
+		"00000000-0000-4000-8000-00000000000/",
+		"..000000-0000-4000-8000-000000000000",
+		"ABCDEF00-0000-4000-8000-000000000000",
+	} {
+		f.Add(seed)
+	}
+	objects := filepath.Join(root, "objects") + string(filepath.Separator)
+	outside := func(t *testing.T) map[string]string {
+		files := snapshot(t, base)
+		for p := range files {
+			if strings.HasPrefix(p, objects) {
+				delete(files, p)
+			}
+		}
+		return files
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		_, perr := storage.ParseObjectID(raw)
+		id := storage.ObjectID(raw)
+		before := outside(t)
+		calls := map[string]error{}
+		_, calls["StatBlob"] = s.StatBlob(ctx, id)
+		b, err := s.OpenBlob(ctx, id)
+		if err == nil {
+			b.Close()
+		}
+		calls["OpenBlob"] = err
+		_, _, calls["PutBlob"] = s.PutBlob(ctx, id, strings.NewReader("data"))
+		calls["Delete"] = s.Delete(ctx, id)
+		for op, err := range calls {
+			if invalid := errors.Is(err, storage.ErrInvalidID); invalid != (perr != nil) {
+				t.Errorf("%s(%q): ParseObjectID error %v, store error %v", op, raw, perr, err)
+			}
+		}
+		if after := outside(t); !maps.Equal(before, after) {
+			t.Fatalf("calls with %q changed files outside %s", raw, objects)
+		}
+	})
+}
@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Index is an embedded database (bbolt) mirroring every object's Meta with
+// secondary keys for expiry, tombstone age, uploads and owners, so GC and
+// queries never have to walk the object tree. The meta.json files remain the
+// source of truth; an index lost or out of date is rebuilt from them.
+type Index struct {
+	db *bolt.DB
+}
+
+var (
+	bktMeta      = []byte("meta")      // id → Meta JSON
+	bktExpires   = []byte("expires")   // ExpiresAt|id, live objects that expire
+	bktAging     = []byte("aging")     // since|id, tombstones and objects without expiry
+	bktUploading = []byte("uploading") // id
+	bktOwners    = []byte("owners")    // ownerHash/id
+	bktUsage     = []byte("usage")     // keyTotal, ownerHash, room/<room> or client/<client> → Usage of live objects
+	bktInfo      = []byte("info")
+
+	keyBuilt = []byte("built") // layout version, set once the index reflects the whole store
+	keyClean = []byte("clean") // set while no process has the store open
+	keyTotal = []byte("-")     // whole-store usage; owner hashes are hex
+)
+
+// indexVersion changes whenever buckets are added, forcing a rebuild of
+// indexes written by older versions.
+const indexVersion = "3"
+
+// Query selects objects for Index.Query and Lister.List. Zero fields match
+// everything.
+type Query struct {
+	State     State
+	OwnerHash string
+}
+
+func (q Query) match(m Meta) bool {
+	return (q.State == "" || m.State == q.State) &&
+		(q.OwnerHash == "" || m.OwnerHash == q.OwnerHash)
+}
+
+// Lister is implemented by stores that can enumerate their objects. fn is
+// called once per matching object until it returns false.
+type Lister interface {
+	List(q Query, fn func(ObjectID, Meta) bool) error
+}
+
+// Usage counts live (not tombstoned) objects and the blob bytes they hold.
+type Usage struct {
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Accountant is implemented by stores that track usage in total, per owner,
+// per room and per creating client, which quotas are enforced against.
+type Accountant interface {
+	Usage(ownerHash string) (owner, total Usage, err error)
+	// GroupUsage returns the usage of the objects linked to room and of
+	// those created by client (see CreateOptions). Empty names count nothing.
+	GroupUsage(room, client string) (r, c Usage, err error)
+}
+
+// OpenIndex opens or creates the index database at path. Only one process
+// may hold it; a second open fails after a second instead of blocking.
+func OpenIndex(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("index %s is locked by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bktMeta, bktExpires, bktAging, bktUploading, bktOwners, bktUsage, bktInfo} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Index{db: db}, nil
+}
+
+func (x *Index) Close() error { return x.db.Close() }
+
+// Built reports whether the index has been populated by Rebuild with the
+// current layout.
+func (x *Index) Built() bool {
+	var ok bool
+	_ = x.db.View(func(tx *bolt.Tx) error {
+		ok = string(tx.Bucket(bktInfo).Get(keyBuilt)) == indexVersion
+		return nil
+	})
+	return ok
+}
+
+// begin clears the clean-shutdown marker and reports whether it was set,
+// i.e. whether the last process using the store closed it properly.
+func (x *Index) begin() (bool, error) {
+	var clean bool
+	err := x.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktInfo)
+		clean = b.Get(keyClean) != nil
+		return b.Delete(keyClean)
+	})
+	return clean, err
+}
+
+// end sets the clean-shutdown marker.
+func (x *Index) end() error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bktInfo).Put(keyClean, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+}
+
+// Put records m as the current meta of id.
+func (x *Index) Put(id ObjectID, m Meta) error {
+	return x.db.Update(func(tx *bolt.Tx) error { return put(tx, id, m) })
+}
+
+// Delete forgets id entirely.
+func (x *Index) Delete(id ObjectID) error {
+	return x.db.Update(func(tx *bolt.Tx) error { return del(tx, id) })
+}
+
+// Get returns the indexed meta of id or an error matching os.ErrNotExist.
+func (x *Index) Get(id ObjectID) (Meta, error) {
+	var m Meta
+	err := x.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bktMeta).Get([]byte(id))
+		if v == nil {
+			return fmt.Errorf("index %s: %w", id, os.ErrNotExist)
+		}
+		return json.Unmarshal(v, &m)
+	})
+	return m, err
+}
+
+// Query calls fn for every object matching q, in id order, until fn returns
+// false. fn must not call back into the index.
+func (x *Index) Query(q Query, fn func(ObjectID, Meta) bool) error {
+	err := x.db.View(func(tx *bolt.Tx) error {
+		metas := tx.Bucket(bktMeta)
+		if q.OwnerHash != "" {
+			prefix := []byte(q.OwnerHash + "/")
+			c := tx.Bucket(bktOwners).Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				id := k[len(prefix):]
+				v := metas.Get(id)
+				if v == nil {
+					continue
+				}
+				var m Meta
+				if err := json.Unmarshal(v, &m); err != nil {
+					return err
+				}
+				if q.match(m) && !fn(ObjectID(id), m) {
+					return nil
+				}
+			}
+			return nil
+		}
+		return metas.ForEach(func(k, v []byte) error {
+			var m Meta
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			if q.match(m) && !fn(ObjectID(k), m) {
+				return errStop
+			}
+			return nil
+		})
+	})
+	if errors.Is(err, errStop) {
+		return nil
+	}
+	return err
+}
+
+var errStop = errors.New("stop")
+
+// Usage returns the usage of ownerHash's objects and of the whole store.
+func (x *Index) Usage(ownerHash string) (owner, total Usage, err error) {
+	err = x.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktUsage)
+		total = decodeUsage(b.Get(keyTotal))
+		if ownerHash != "" {
+			owner = decodeUsage(b.Get([]byte(ownerHash)))
+		}
+		return nil
+	})
+	return owner, total, err
+}
+
+// GroupUsage returns the usage of room's objects and of client's.
+func (x *Index) GroupUsage(room, client string) (r, c Usage, err error) {
+	err = x.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktUsage)
+		if room != "" {
+			r = decodeUsage(b.Get(roomKey(room)))
+		}
+		if client != "" {
+			c = decodeUsage(b.Get(clientKey(client)))
+		}
+		return nil
+	})
+	return r, c, err
+}
+
+func roomKey(room string) []byte     { return []byte("room/" + room) }
+func clientKey(client string) []byte { return []byte("client/" + client) }
+
+// addUsage adds sign times m's contribution to the total, its owner, room
+// and client.
+func addUsage(tx *bolt.Tx, m Meta, sign int) error {
+	if m.State.Terminal() {
+		return nil
+	}
+	keys := [][]byte{keyTotal}
+	if m.OwnerHash != "" {
+		keys = append(keys, []byte(m.OwnerHash))
+	}
+	if m.Room != "" {
+		keys = append(keys, roomKey(m.Room))
+	}
+	if m.Client != "" {
+		keys = append(keys, clientKey(m.Client))
+	}
+	b := tx.Bucket(bktUsage)
+	for _, k := range keys {
+		u := decodeUsage(b.Get(k))
+		u.Objects += sign
+		u.Bytes += int64(sign) * m.Size
+		if err := b.Put(k, encodeUsage(u)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeUsage(u Usage) []byte {
+	v := make([]byte, 16)
+	binary.BigEndian.PutUint64(v, uint64(u.Objects))
+	binary.BigEndian.PutUint64(v[8:], uint64(u.Bytes))
+	return v
+}
+
+func decodeUsage(v []byte) Usage {
+	if len(v) != 16 {
+		return Usage{}
+	}
+	return Usage{Objects: int(binary.BigEndian.Uint64(v)), Bytes: int64(binary.BigEndian.Uint64(v[8:]))}
+}
+
+// Rebuild replaces the whole index with metas in one transaction.
+func (x *Index) Rebuild(metas map[ObjectID]Meta) error {
+	return x.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bktMeta, bktExpires, bktAging, bktUploading, bktOwners, bktUsage} {
+			if err := tx.DeleteBucket(b); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(b); err != nil {
+				return err
+			}
+		}
+		for id, m := range metas {
+			if err := put(tx, id, m); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bktInfo).Put(keyBuilt, []byte(indexVersion))
+	})
+}
+
+// gcCandidates returns the ids GC has to look at: objects past ExpiresAt,
+// tombstones and expiry-less objects older than ttl, and every upload.
+func (x *Index) gcCandidates(now time.Time, ttl time.Duration) ([]ObjectID, error) {
+	var ids []ObjectID
+	err := x.db.View(func(tx *bolt.Tx) error {
+		ids = appendBefore(ids, tx.Bucket(bktExpires), now)
+		ids = appendBefore(ids, tx.Bucket(bktAging), now.Add(-ttl))
+		return tx.Bucket(bktUploading).ForEach(func(k, _ []byte) error {
+			ids = append(ids, ObjectID(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// appendBefore appends the ids of time-keyed entries at or before t.
+func appendBefore(ids []ObjectID, b *bolt.Bucket, t time.Time) []ObjectID {
+	limit := timeKey(t, "")
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, _ = c.Next() {
+		ids = append(ids, ObjectID(k[8:]))
+	}
+	return ids
+}
+
+func timeKey(t time.Time, id ObjectID) []byte {
+	k := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(k, id...)
+}
+
+// secondary returns the secondary index entries for one object.
+func secondary(id ObjectID, m Meta) map[string][]byte {
+	keys := make(map[string][]byte, 3)
+	switch {
+	case m.State.Terminal():
+		keys[string(bktAging)] = timeKey(m.UpdatedAt, id)
+	case m.ExpiresAt.IsZero():
+		keys[string(bktAging)] = timeKey(m.CreatedAt, id)
+	default:
+		keys[string(bktExpires)] = timeKey(m.ExpiresAt, id)
+	}
+	if m.State == StateUploading {
+		keys[string(bktUploading)] = []byte(id)
+	}
+	if m.OwnerHash != "" {
+		keys[string(bktOwners)] = []byte(m.OwnerHash + "/" + string(id))
+	}
+	return keys
+}
+
+func put(tx *bolt.Tx, id ObjectID, m Meta) error {
+	if err := del(tx, id); err != nil {
+		return err
+	}
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bktMeta).Put([]byte(id), v); err != nil {
+		return err
+	}
+	if err := addUsage(tx, m, +1); err != nil {
+		return err
+	}
+	for b, k := range secondary(id, m) {
+		if err := tx.Bucket([]byte(b)).Put(k, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func del(tx *bolt.Tx, id ObjectID) error {
+	metas := tx.Bucket(bktMeta)
+	v := metas.Get([]byte(id))
+	if v == nil {
+		return nil
+	}
+	var old Meta
+	if err := json.Unmarshal(v, &old); err != nil {
+		return err
+	}
+	for b, k := range secondary(id, old) {
+		if err := tx.Bucket([]byte(b)).Delete(k); err != nil {
+			return err
+		}
+	}
+	if err := addUsage(tx, old, -1); err != nil {
+		return err
+	}
+	return metas.Delete([]byte(id))
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keyring holds the key-encryption keys (KEKs) of an EncryptedStore. New
+// data keys are wrapped with the active key; the others stay available so
+// objects written before a rotation can still be read.
+//
+// The key file has one "<id> <base64 32-byte key>" per line; blank lines and
+// lines starting with # are ignored. The last key is the active one, so a
+// rotation appends a line (see "noisytransferd genkey") and restarts. A key
+// may be removed once every object wrapped with it has expired.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// ErrUnknownKey is returned for data encrypted with a key the keyring does
+// not hold, e.g. one removed while objects wrapped with it were still live.
+var ErrUnknownKey = errors.New("encryption key not in keyring")
+
+// LoadKeyring reads a key file.
+func LoadKeyring(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, b64, ok := strings.Cut(line, " ")
+		if !ok || id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("%s:%d: want \"<id> <base64 key>\"", path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key must be 32 bytes of base64", path, n)
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate key id %q", path, n, id)
+		}
+		if k.keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+		k.active = id
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if k.active == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return k, nil
+}
+
+// Active returns the id of the key new objects are wrapped with.
+func (k *Keyring) Active() string { return k.active }
+
+// wrap encrypts a data key, or another small secret, with the active KEK.
+// The key id and ad are authenticated along with it.
+func (k *Keyring) wrap(dek, ad []byte) (id string, wrapped []byte, err error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.active, aead.Seal(nonce, nonce, dek, append([]byte(k.active), ad...)), nil
+}
+
+// unwrap recovers a secret wrapped with KEK id and the same ad.
+func (k *Keyring) unwrap(id string, wrapped, ad []byte) ([]byte, error) {
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	ns := aead.NonceSize()
+	if len(wrapped) < ns {
+		return nil, errors.New("wrapped data key too short")
+	}
+	return aead.Open(nil, wrapped[:ns], wrapped[ns:], append([]byte(id), ad...))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
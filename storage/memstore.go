@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTooLarge is returned when a single blob or manifest exceeds a size limit.
+	ErrTooLarge = errors.New("object too large")
+	// ErrInsufficientStorage is returned when the store has no room left.
+	ErrInsufficientStorage = errors.New("insufficient storage")
+)
+
+// MemStore keeps everything in process memory. It is meant for tests and for
+// deployments that must not touch disk; all data is lost on restart.
+type MemStore struct {
+	maxBytes       int64 // total blob+manifest bytes; 0 = unlimited
+	maxObjectBytes int64 // per blob, manifests only count toward maxBytes; 0 = unlimited
+
+	mu      sync.Mutex
+	objects map[ObjectID]*memObject
+	used    int64
+	active  map[ObjectID]struct{} // ids with a PutBlob streaming
+}
+
+type memObject struct {
+	meta     Meta
+	blob     []byte // staged or committed; never mutated once assigned
+	manifest []byte
+}
+
+// NewMemStore returns an empty store holding at most maxBytes of blobs and
+// manifests in total and maxObjectBytes per blob. Zero disables a cap.
+func NewMemStore(maxBytes, maxObjectBytes int64) *MemStore {
+	return &MemStore{
+		maxBytes:       maxBytes,
+		maxObjectBytes: maxObjectBytes,
+		objects:        make(map[ObjectID]*memObject),
+		active:         make(map[ObjectID]struct{}),
+	}
+}
+
+func (s *MemStore) Create(ctx context.Context, opts CreateOptions) (ObjectID, error) {
+	id := NewObjectID()
+	m := newMeta(opts, time.Now().UTC())
+	s.mu.Lock()
+	s.objects[id] = &memObject{meta: m}
+	s.mu.Unlock()
+	return id, nil
+}
+
+// PutBlob copies r into memory, reserving capacity chunk by chunk so that
+// concurrent uploads can never overcommit the store.
+func (s *MemStore) PutBlob(ctx context.Context, id ObjectID, r io.Reader) (int64, string, error) {
+	if _, err := s.update(id, func(o *memObject) error {
+		if err := o.meta.transition(id, "upload", StateUploading); err != nil {
+			return err
+		}
+		s.used -= int64(len(o.blob)) // a re-upload replaces the staged blob
+		o.blob = nil
+		o.meta.Size, o.meta.ETag = 0, ""
+		s.active[id] = struct{}{}
+		return nil
+	}); err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.active, id)
+		s.mu.Unlock()
+	}()
+
+	h := sha256.New()
+	data, err := s.readReserved(io.TeeReader(r, h), s.maxObjectBytes)
+	etag := hex.EncodeToString(h.Sum(nil))
+
+	if err == nil {
+		_, err = s.update(id, func(o *memObject) error {
+			if err := o.meta.transition(id, "upload", StateUploaded); err != nil {
+				return err // deleted or expired while streaming
+			}
+			o.blob = data
+			o.meta.Size, o.meta.ETag = int64(len(data)), etag
+			o.meta.scheduleExpiry(time.Now())
+			return nil
+		})
+	}
+	if err != nil {
+		s.release(data)
+		_, _ = s.update(id, func(o *memObject) error {
+			o.meta.Size, o.meta.ETag = 0, ""
+			if err := o.meta.transition(id, "upload", StateCreated); err != nil {
+				return err
+			}
+			o.meta.scheduleExpiry(time.Now())
+			return nil
+		})
+		return 0, "", err
+	}
+	return int64(len(data)), etag, nil
+}
+
+func (s *MemStore) PutManifest(ctx context.Context, id ObjectID, r io.Reader) error {
+	m, err := s.StatBlob(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := m.requireMutable(id, "put manifest"); err != nil {
+		return err
+	}
+	data, err := s.readReserved(r, 0) // maxObjectBytes caps blobs only
+	if err != nil {
+		return err
+	}
+	_, err = s.update(id, func(o *memObject) error {
+		if err := o.meta.requireMutable(id, "put manifest"); err != nil {
+			return err
+		}
+		s.used -= int64(len(o.manifest))
+		o.manifest = data
+		return nil
+	})
+	if err != nil {
+		s.release(data)
+	}
+	return err
+}
+
+func (s *MemStore) Commit(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.update(id, func(o *memObject) error {
+		if o.meta.State == StateUploaded && o.manifest == nil {
+			return ErrManifestMissing
+		}
+		if err := o.meta.transition(id, "commit", StateCommitted); err != nil {
+			return err
+		}
+		o.meta.CommittedAt = time.Now().UTC()
+		o.meta.scheduleExpiry(o.meta.CommittedAt)
+		return nil
+	})
+}
+
+func (s *MemStore) StatBlob(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.update(id, func(*memObject) error { return nil })
+}
+
+func (s *MemStore) OpenBlob(ctx context.Context, id ObjectID) (Blob, error) {
+	var data []byte
+	m, err := s.update(id, func(o *memObject) error {
+		if o.meta.State != StateCommitted {
+			return &StateError{ID: id, State: o.meta.State, Op: "read blob"}
+		}
+		data = o.blob
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewBlob(memReader{bytes.NewReader(data)}, blobInfo(m)), nil
+}
+
+func (s *MemStore) GetManifest(ctx context.Context, id ObjectID) (io.ReadCloser, error) {
+	var data []byte
+	_, err := s.update(id, func(o *memObject) error {
+		if o.meta.State.Terminal() {
+			return &StateError{ID: id, State: o.meta.State, Op: "get manifest"}
+		}
+		if o.manifest == nil {
+			return os.ErrNotExist
+		}
+		data = o.manifest
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemStore) RecordDownload(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.update(id, func(o *memObject) error {
+		if o.meta.State != StateCommitted {
+			return &StateError{ID: id, State: o.meta.State, Op: "download"}
+		}
+		o.meta.Downloads++
+		if o.meta.MaxDownloads > 0 && o.meta.Downloads >= o.meta.MaxDownloads {
+			if err := o.meta.transition(id, "download", StateExpired); err != nil {
+				return err
+			}
+			s.removeDataLocked(o)
+		}
+		return nil
+	})
+}
+
+func (s *MemStore) Delete(ctx context.Context, id ObjectID) error {
+	_, err := s.update(id, func(o *memObject) error {
+		if err := o.meta.transition(id, "delete", StateDeleted); err != nil {
+			return err
+		}
+		s.removeDataLocked(o)
+		return nil
+	})
+	return err
+}
+
+func (s *MemStore) GC(ctx context.Context, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, o := range s.objects {
+		switch gcDecide(o.meta, now, ttl) {
+		case gcPurge:
+			s.removeDataLocked(o)
+			delete(s.objects, id)
+		case gcExpire:
+			s.expireLocked(id, o, now)
+		case gcResetUpload:
+			s.resetStaleUploadLocked(id, o, now)
+		}
+	}
+	return nil
+}
+
+// resetStaleUploadLocked returns an upload whose PutBlob is gone, say
+// after a panic the HTTP server recovered from, to created.
+func (s *MemStore) resetStaleUploadLocked(id ObjectID, o *memObject, now time.Time) {
+	if _, live := s.active[id]; live {
+		return
+	}
+	if o.meta.transition(id, "reset", StateCreated) != nil {
+		return
+	}
+	s.used -= int64(len(o.blob))
+	o.blob = nil
+	o.meta.Size, o.meta.ETag = 0, ""
+	o.meta.scheduleExpiry(now)
+	o.meta.UpdatedAt = now.UTC()
+}
+
+// SetAttrs merges attrs into the object's Attrs before commit.
+func (s *MemStore) SetAttrs(ctx context.Context, id ObjectID, attrs map[string]string) (Meta, error) {
+	return s.update(id, func(o *memObject) error { return o.meta.setAttrs(id, attrs) })
+}
+
+// Usage sums the live objects.
+func (s *MemStore) Usage(ownerHash string) (owner, total Usage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.objects {
+		if o.meta.State.Terminal() {
+			continue
+		}
+		total.Objects++
+		total.Bytes += o.meta.Size
+		if ownerHash != "" && o.meta.OwnerHash == ownerHash {
+			owner.Objects++
+			owner.Bytes += o.meta.Size
+		}
+	}
+	return owner, total, nil
+}
+
+// GroupUsage sums the live objects of room and of client.
+func (s *MemStore) GroupUsage(room, client string) (r, c Usage, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.objects {
+		if o.meta.State.Terminal() {
+			continue
+		}
+		if room != "" && o.meta.Room == room {
+			r.Objects++
+			r.Bytes += o.meta.Size
+		}
+		if client != "" && o.meta.Client == client {
+			c.Objects++
+			c.Bytes += o.meta.Size
+		}
+	}
+	return r, c, nil
+}
+
+// List calls fn for a snapshot of the matching objects in id order.
+func (s *MemStore) List(q Query, fn func(ObjectID, Meta) bool) error {
+	s.mu.Lock()
+	metas := make(map[ObjectID]Meta)
+	for id, o := range s.objects {
+		if q.match(o.meta) {
+			metas[id] = o.meta
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range slices.Sorted(maps.Keys(metas)) {
+		if !fn(id, metas[id]) {
+			break
+		}
+	}
+	return nil
+}
+
+// helpers
+
+// update runs fn on the object under the store lock, expiring it first if
+// its time is up. Unlike the persistent stores there is nothing to write back.
+func (s *MemStore) update(id ObjectID, fn func(*memObject) error) (Meta, error) {
+	if err := checkID(id); err != nil {
+		return Meta{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.objects[id]
+	if o == nil {
+		return Meta{}, os.ErrNotExist
+	}
+	now := time.Now().UTC()
+	s.expireLocked(id, o, now)
+	before := o.meta
+	if err := fn(o); err != nil {
+		o.meta = before
+		return Meta{}, err
+	}
+	if !reflect.DeepEqual(o.meta, before) {
+		o.meta.UpdatedAt = now
+	}
+	return o.meta, nil
+}
+
+func (s *MemStore) expireLocked(id ObjectID, o *memObject, now time.Time) {
+	if !o.meta.Expired(now) {
+		return
+	}
+	if o.meta.transition(id, "expire", StateExpired) == nil {
+		o.meta.UpdatedAt = now
+		s.removeDataLocked(o)
+	}
+}
+
+func (s *MemStore) removeDataLocked(o *memObject) {
+	s.used -= int64(len(o.blob) + len(o.manifest))
+	o.blob, o.manifest = nil, nil
+}
+
+// readReserved reads r into memory, reserving capacity chunk by chunk so
+// that concurrent writes can never overcommit the store and a stream never
+// holds more than the store has left. limit caps the total read (0 = none).
+// Nothing stays reserved when it fails.
+func (s *MemStore) readReserved(r io.Reader, limit int64) ([]byte, error) {
+	buf := []byte{} // non-nil when empty: a nil manifest means none
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			if rerr := s.reserve(int64(len(buf)), int64(n), limit); rerr != nil {
+				s.release(buf)
+				return nil, rerr
+			}
+			buf = append(buf, chunk[:n]...)
+		}
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			s.release(buf)
+			return nil, err
+		}
+	}
+}
+
+// reserve claims n more bytes for an object already holding have bytes,
+// holding it to limit (0 = none).
+func (s *MemStore) reserve(have, n, limit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit > 0 && have+n > limit {
+		return ErrTooLarge
+	}
+	if s.maxBytes > 0 && s.used+n > s.maxBytes {
+		return ErrInsufficientStorage
+	}
+	s.used += n
+	return nil
+}
+
+func (s *MemStore) release(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.used -= int64(len(b))
+	s.mu.Unlock()
+}
+
+type memReader struct{ *bytes.Reader }
+
+func (memReader) Close() error { return nil }
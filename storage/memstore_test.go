@@ -0,0 +1,85 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+	"github.com/collapsinghierarchy/noisytransfer/storage/storagetest"
+)
+
+func TestMemStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store { return storage.NewMemStore(0, 0) })
+}
+
+// endlessReader never runs out and counts what was read from it.
+type endlessReader struct{ n int64 }
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	e.n += int64(len(p))
+	return len(p), nil
+}
+
+// TestMemStoreManifestBudget checks that a manifest is read no further than
+// the store has room for, and that only blobs are held to the per-object cap.
+func TestMemStoreManifestBudget(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemStore(1<<20, 10)
+	id, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutManifest(ctx, id, strings.NewReader(strings.Repeat("m", 100))); err != nil {
+		t.Fatalf("manifest over the per-object cap: %v", err)
+	}
+	r := &endlessReader{}
+	if err := s.PutManifest(ctx, id, r); !errors.Is(err, storage.ErrInsufficientStorage) {
+		t.Fatalf("endless manifest: want ErrInsufficientStorage, got %v", err)
+	}
+	if r.n > 2<<20 {
+		t.Fatalf("read %d bytes of a manifest into a 1 MiB store", r.n)
+	}
+	// The failed write released what it had reserved.
+	if _, _, err := s.PutBlob(ctx, id, strings.NewReader("0123456789")); err != nil {
+		t.Fatalf("PutBlob after failed manifest: %v", err)
+	}
+	if _, _, err := s.PutBlob(ctx, id, strings.NewReader("0123456789a")); !errors.Is(err, storage.ErrTooLarge) {
+		t.Fatalf("blob over the per-object cap: want ErrTooLarge, got %v", err)
+	}
+}
+
+// panicReader panics on its first read, as a failing handler might.
+type panicReader struct{}
+
+func (panicReader) Read([]byte) (int, error) { panic("reader failed") }
+
+// TestMemStoreResetsAbandonedUpload checks that GC returns an upload whose
+// PutBlob panicked to created instead of leaving it uploading for good.
+func TestMemStoreResetsAbandonedUpload(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemStore(0, 0)
+	id, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() { _ = recover() }()
+		_, _, _ = s.PutBlob(ctx, id, panicReader{})
+	}()
+	if m, err := s.StatBlob(ctx, id); err != nil || m.State != storage.StateUploading {
+		t.Fatalf("after panic: %+v, %v", m, err)
+	}
+	if err := s.GC(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s.StatBlob(ctx, id)
+	if err != nil || m.State != storage.StateCreated {
+		t.Fatalf("after GC: %+v, %v", m, err)
+	}
+	if _, _, err := s.PutBlob(ctx, id, strings.NewReader("data")); err != nil {
+		t.Fatalf("upload after reset: %v", err)
+	}
+}
@@ -0,0 +1,271 @@
+// Package s3fake is a small in-process S3 endpoint for tests. It speaks the
+// subset of the S3 REST API used by storage.S3Store (path-style addressing,
+// object PUT/GET/HEAD/DELETE with Range, multipart upload and ListObjectsV2)
+// and keeps everything in memory. Requests must carry a SigV4 Authorization
+// header, but signatures are not verified.
+package s3fake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const minPartSize = 5 << 20
+
+type object struct {
+	data    []byte
+	ctype   string
+	modTime time.Time
+}
+
+type upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// Server is an http.Handler serving any number of buckets.
+type Server struct {
+	mu      sync.Mutex
+	objects map[string]*object // "bucket/key" -> object
+	uploads map[string]*upload // uploadId -> upload
+	nextID  int
+}
+
+func New() *Server {
+	return &Server{objects: make(map[string]*object), uploads: make(map[string]*upload)}
+}
+
+// Keys returns the stored keys of bucket, sorted.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keysLocked(bucket)
+}
+
+// PendingUploads is the number of multipart uploads neither completed nor aborted.
+func (s *Server) PendingUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		writeError(w, http.StatusForbidden, "AccessDenied", "missing SigV4 authorization")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket == "" {
+		writeError(w, http.StatusBadRequest, "InvalidBucketName", "bucket required")
+		return
+	}
+	q := r.URL.Query()
+	full := bucket + "/" + key
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && q.Get("list-type") == "2":
+		s.list(w, bucket, q.Get("prefix"), q.Get("continuation-token"), q.Get("max-keys"))
+	case key == "":
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "bucket operation")
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		s.createUpload(w, full)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		s.uploadPart(w, r, q.Get("uploadId"), q.Get("partNumber"))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		s.completeUpload(w, r, full, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		s.mu.Lock()
+		delete(s.uploads, q.Get("uploadId"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		s.mu.Lock()
+		s.objects[full] = &object{data: data, ctype: r.Header.Get("Content-Type"), modTime: time.Now()}
+		s.mu.Unlock()
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.mu.Lock()
+		o := s.objects[full]
+		s.mu.Unlock()
+		if o == nil {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if o.ctype != "" {
+			w.Header().Set("Content-Type", o.ctype)
+		}
+		w.Header().Set("ETag", etag(o.data))
+		http.ServeContent(w, r, "", o.modTime, bytes.NewReader(o.data))
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, full)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, bucket, prefix, after, maxKeys string) {
+	limit := 1000
+	if n, err := strconv.Atoi(maxKeys); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	type content struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	}
+	var out struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Name                  string    `xml:"Name"`
+		Prefix                string    `xml:"Prefix"`
+		KeyCount              int       `xml:"KeyCount"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+		Contents              []content `xml:"Contents"`
+	}
+	out.Name, out.Prefix = bucket, prefix
+	s.mu.Lock()
+	for _, k := range s.keysLocked(bucket) {
+		if !strings.HasPrefix(k, prefix) || k <= after {
+			continue
+		}
+		if len(out.Contents) == limit {
+			out.IsTruncated = true
+			out.NextContinuationToken = out.Contents[limit-1].Key
+			break
+		}
+		out.Contents = append(out.Contents, content{Key: k, Size: len(s.objects[bucket+"/"+k].data)})
+	}
+	s.mu.Unlock()
+	out.KeyCount = len(out.Contents)
+	writeXML(w, http.StatusOK, out)
+}
+
+func (s *Server) keysLocked(bucket string) []string {
+	var keys []string
+	for k := range s.objects {
+		if rest, ok := strings.CutPrefix(k, bucket+"/"); ok {
+			keys = append(keys, rest)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, full string) {
+	s.mu.Lock()
+	s.nextID++
+	id := fmt.Sprintf("upload-%d", s.nextID)
+	s.uploads[id] = &upload{key: full, parts: make(map[int][]byte)}
+	s.mu.Unlock()
+	bucket, key, _ := strings.Cut(full, "/")
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, id, num string) {
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "bad partNumber")
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	s.mu.Lock()
+	u := s.uploads[id]
+	if u != nil {
+		u.parts[n] = data
+	}
+	s.mu.Unlock()
+	if u == nil {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, r *http.Request, full, id string) {
+	var req struct {
+		Parts []struct {
+			Number int    `xml:"PartNumber"`
+			ETag   string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.uploads[id]
+	if u == nil || u.key != full {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	var buf bytes.Buffer
+	for i, p := range req.Parts {
+		data, ok := u.parts[p.Number]
+		if !ok || etag(data) != p.ETag || (i > 0 && p.Number <= req.Parts[i-1].Number) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(p.Number))
+			return
+		}
+		if i < len(req.Parts)-1 && len(data) < minPartSize {
+			writeError(w, http.StatusBadRequest, "EntityTooSmall", strconv.Itoa(p.Number))
+			return
+		}
+		buf.Write(data)
+	}
+	delete(s.uploads, id)
+	s.objects[full] = &object{data: buf.Bytes(), ctype: "application/octet-stream", modTime: time.Now()}
+	bucket, key, _ := strings.Cut(full, "/")
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+	}{Bucket: bucket, Key: key})
+}
+
+func etag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: msg})
+}
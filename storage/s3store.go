@@ -0,0 +1,790 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Config points an S3Store at any S3-compatible endpoint (AWS, MinIO, R2,
+// Ceph RGW, ...).
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com or http://127.0.0.1:9000
+	Region    string // signing region; "us-east-1" if empty
+	Bucket    string
+	Prefix    string // optional key prefix, e.g. "noisytransfer/"
+	AccessKey string
+	SecretKey string
+	PathStyle bool         // address the bucket as /bucket/key instead of bucket.host/key
+	PartSize  int64        // multipart part size; default 8 MiB, minimum 5 MiB
+	Client    *http.Client // defaults to http.DefaultClient
+	Logger    *slog.Logger // reports metas GC cannot read; defaults to slog.Default()
+}
+
+// S3Store implements Store on top of an S3 bucket.
+//
+// Keys are grouped by kind so bucket lifecycle rules can target them:
+//
+//	<prefix>meta/<id>.json      object metadata (state machine)
+//	<prefix>manifests/<id>.json manifest
+//	<prefix>blobs/<id>          blob, written with multipart upload
+//
+// A lifecycle rule aborting incomplete multipart uploads after a day cleans
+// up after crashed uploads; an expiration rule longer than the server's
+// maximum TTL is a safe backstop for GC.
+//
+// Meta updates are read-modify-write serialized by an in-process lock per
+// object, so a bucket must not be shared by several noisytransferd instances.
+// Like FSStore, a blob removed by Delete or the last download stays readable
+// to readers that already opened it: its key is deleted when they close.
+type S3Store struct {
+	cfg  S3Config
+	base *url.URL
+
+	mu      sync.Mutex
+	active  map[ObjectID]struct{}
+	locks   map[ObjectID]*objectLock
+	readers map[ObjectID]int      // open blob readers per object
+	doomed  map[ObjectID]struct{} // blobs to delete once their last reader closes
+}
+
+// objectLock serializes the meta updates of one object; refs counts the
+// updates holding or waiting for it, so idle locks are dropped.
+type objectLock struct {
+	sync.Mutex
+	refs int
+}
+
+const (
+	s3DefaultPartSize = 8 << 20
+	s3MinPartSize     = 5 << 20
+)
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: bucket required")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = s3DefaultPartSize
+	}
+	if cfg.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("s3: part size %d below S3 minimum %d", cfg.PartSize, s3MinPartSize)
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &S3Store{
+		cfg:     cfg,
+		base:    u,
+		active:  make(map[ObjectID]struct{}),
+		locks:   make(map[ObjectID]*objectLock),
+		readers: make(map[ObjectID]int),
+		doomed:  make(map[ObjectID]struct{}),
+	}, nil
+}
+
+func (s *S3Store) metaKey(id ObjectID) string { return s.cfg.Prefix + "meta/" + string(id) + ".json" }
+func (s *S3Store) manifestKey(id ObjectID) string {
+	return s.cfg.Prefix + "manifests/" + string(id) + ".json"
+}
+func (s *S3Store) blobKey(id ObjectID) string { return s.cfg.Prefix + "blobs/" + string(id) }
+
+func (s *S3Store) Create(ctx context.Context, opts CreateOptions) (ObjectID, error) {
+	id := NewObjectID()
+	m := newMeta(opts, time.Now().UTC())
+	if err := s.writeMeta(ctx, id, m); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// PutBlob streams r to the bucket, one part at a time, so memory use is
+// bounded by PartSize regardless of blob size.
+func (s *S3Store) PutBlob(ctx context.Context, id ObjectID, r io.Reader) (int64, string, error) {
+	if _, err := s.update(ctx, id, func(m *Meta) error {
+		if err := m.transition(id, "upload", StateUploading); err != nil {
+			return err
+		}
+		m.Size, m.ETag = 0, "" // a re-upload replaces the staged blob
+		s.mu.Lock()
+		s.active[id] = struct{}{}
+		s.mu.Unlock()
+		return nil
+	}); err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.active, id)
+		s.mu.Unlock()
+	}()
+
+	n, etag, err := s.writeBlob(ctx, s.blobKey(id), r)
+	if err == nil {
+		_, err = s.update(ctx, id, func(m *Meta) error {
+			if err := m.transition(id, "upload", StateUploaded); err != nil {
+				return err // deleted or expired while streaming
+			}
+			m.Size, m.ETag = n, etag
+			m.scheduleExpiry(time.Now())
+			return nil
+		})
+	}
+	if err != nil {
+		bg := context.WithoutCancel(ctx)
+		_ = s.deleteKey(bg, s.blobKey(id))
+		_, _ = s.update(bg, id, func(m *Meta) error {
+			m.Size, m.ETag = 0, ""
+			if err := m.transition(id, "upload", StateCreated); err != nil {
+				return err
+			}
+			m.scheduleExpiry(time.Now())
+			return nil
+		})
+		return 0, "", err
+	}
+	return n, etag, nil
+}
+
+func (s *S3Store) PutManifest(ctx context.Context, id ObjectID, r io.Reader) error {
+	m, err := s.current(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := m.requireMutable(id, "put manifest"); err != nil {
+		return err
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// Write under the meta lock so a racing commit sees a complete manifest.
+	_, err = s.update(ctx, id, func(m *Meta) error {
+		if err := m.requireMutable(id, "put manifest"); err != nil {
+			return err
+		}
+		return s.putObject(ctx, s.manifestKey(id), body, "application/json")
+	})
+	return err
+}
+
+func (s *S3Store) Commit(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.update(ctx, id, func(m *Meta) error {
+		if m.State == StateUploaded {
+			if _, err := s.headObject(ctx, s.manifestKey(id)); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return ErrManifestMissing
+				}
+				return err
+			}
+		}
+		if err := m.transition(id, "commit", StateCommitted); err != nil {
+			return err
+		}
+		m.CommittedAt = time.Now().UTC()
+		m.scheduleExpiry(m.CommittedAt)
+		return nil
+	})
+}
+
+func (s *S3Store) StatBlob(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.current(ctx, id)
+}
+
+// OpenBlob returns a reader that fetches the blob with ranged GETs, so
+// seeking (and therefore HTTP Range requests) never downloads skipped bytes.
+// The reader is registered under the object's lock, so removeData either
+// sees it or has already tombstoned the object.
+func (s *S3Store) OpenBlob(ctx context.Context, id ObjectID) (Blob, error) {
+	unlock := s.lock(id)
+	m, err := s.readMeta(ctx, id)
+	if err == nil && m.State == StateCommitted && !m.Expired(time.Now()) {
+		s.mu.Lock()
+		s.readers[id]++
+		s.mu.Unlock()
+		unlock()
+		return NewBlob(&s3Reader{s: s, ctx: ctx, id: id, key: s.blobKey(id), size: m.Size}, blobInfo(m)), nil
+	}
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	if m.Expired(time.Now()) {
+		if m, err = s.current(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return nil, &StateError{ID: id, State: m.State, Op: "read blob"}
+}
+
+func (s *S3Store) GetManifest(ctx context.Context, id ObjectID) (io.ReadCloser, error) {
+	m, err := s.current(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.State.Terminal() {
+		return nil, &StateError{ID: id, State: m.State, Op: "get manifest"}
+	}
+	res, err := s.do(ctx, http.MethodGet, s.manifestKey(id), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *S3Store) RecordDownload(ctx context.Context, id ObjectID) (Meta, error) {
+	return s.update(ctx, id, func(m *Meta) error {
+		if m.State != StateCommitted {
+			return &StateError{ID: id, State: m.State, Op: "download"}
+		}
+		m.Downloads++
+		if m.MaxDownloads > 0 && m.Downloads >= m.MaxDownloads {
+			if err := m.transition(id, "download", StateExpired); err != nil {
+				return err
+			}
+			return s.removeData(ctx, id)
+		}
+		return nil
+	})
+}
+
+func (s *S3Store) Delete(ctx context.Context, id ObjectID) error {
+	_, err := s.update(ctx, id, func(m *Meta) error {
+		if err := m.transition(id, "delete", StateDeleted); err != nil {
+			return err
+		}
+		return s.removeData(ctx, id)
+	})
+	return err
+}
+
+func (s *S3Store) GC(ctx context.Context, ttl time.Duration) error {
+	ids, err := s.listIDs(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, id := range ids {
+		m, err := s.readMeta(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				s.cfg.Logger.Warn("s3 gc: skipping unreadable meta", "id", id, "err", err)
+			}
+			continue
+		}
+		switch gcDecide(m, now, ttl) {
+		case gcPurge:
+			s.purge(ctx, id, now, ttl)
+		case gcResetUpload:
+			s.resetStaleUpload(ctx, id)
+		case gcExpire:
+			_, _ = s.current(ctx, id)
+		}
+	}
+	return nil
+}
+
+// purge removes every key of the object. It re-reads the meta under the
+// object's lock, so an update that raced the listing is neither undone nor
+// written back over a purged object.
+func (s *S3Store) purge(ctx context.Context, id ObjectID, now time.Time, ttl time.Duration) {
+	defer s.lock(id)()
+	m, err := s.readMeta(ctx, id)
+	if err != nil || gcDecide(m, now, ttl) != gcPurge {
+		return
+	}
+	if err := s.removeData(ctx, id); err != nil {
+		return
+	}
+	_ = s.deleteKey(ctx, s.metaKey(id))
+}
+
+func (s *S3Store) resetStaleUpload(ctx context.Context, id ObjectID) {
+	_, _ = s.update(ctx, id, func(m *Meta) error {
+		s.mu.Lock()
+		_, live := s.active[id]
+		s.mu.Unlock()
+		if live {
+			return nil
+		}
+		if err := m.transition(id, "reset", StateCreated); err != nil {
+			return err
+		}
+		m.Size, m.ETag = 0, ""
+		m.scheduleExpiry(time.Now())
+		return s.deleteKey(ctx, s.blobKey(id))
+	})
+}
+
+// SetAttrs merges attrs into the object's Attrs before commit.
+func (s *S3Store) SetAttrs(ctx context.Context, id ObjectID, attrs map[string]string) (Meta, error) {
+	return s.update(ctx, id, func(m *Meta) error { return m.setAttrs(id, attrs) })
+}
+
+// helpers
+
+// update mirrors FSStore.update: fn runs on the current meta under the
+// object's lock and the result is written back only if fn succeeds.
+func (s *S3Store) update(ctx context.Context, id ObjectID, fn func(*Meta) error) (Meta, error) {
+	defer s.lock(id)()
+	m, err := s.readMeta(ctx, id)
+	if err != nil {
+		return Meta{}, err
+	}
+	now := time.Now().UTC()
+	if m.Expired(now) {
+		if err := m.transition(id, "expire", StateExpired); err != nil {
+			return Meta{}, err
+		}
+		if err := s.removeData(ctx, id); err != nil {
+			return Meta{}, err
+		}
+		m.UpdatedAt = now
+		if err := s.writeMeta(ctx, id, m); err != nil {
+			return Meta{}, err
+		}
+	}
+	if err := fn(&m); err != nil {
+		return Meta{}, err
+	}
+	m.UpdatedAt = now
+	if err := s.writeMeta(ctx, id, m); err != nil {
+		return Meta{}, err
+	}
+	return m, nil
+}
+
+// lock acquires the lock of object id and returns its release.
+func (s *S3Store) lock(id ObjectID) func() {
+	s.mu.Lock()
+	l := s.locks[id]
+	if l == nil {
+		l = &objectLock{}
+		s.locks[id] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.locks, id)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *S3Store) current(ctx context.Context, id ObjectID) (Meta, error) {
+	m, err := s.readMeta(ctx, id)
+	if err != nil || !m.Expired(time.Now()) {
+		return m, err
+	}
+	return s.update(ctx, id, func(*Meta) error { return nil })
+}
+
+// removeData deletes the blob and manifest, leaving the meta as a tombstone.
+// A blob still being read is only marked; closeReader deletes it. Called
+// with the object's lock held.
+func (s *S3Store) removeData(ctx context.Context, id ObjectID) error {
+	s.mu.Lock()
+	open := s.readers[id] > 0
+	if open {
+		s.doomed[id] = struct{}{}
+	}
+	s.mu.Unlock()
+	if !open {
+		if err := s.deleteKey(ctx, s.blobKey(id)); err != nil {
+			return err
+		}
+	}
+	return s.deleteKey(ctx, s.manifestKey(id))
+}
+
+// closeReader unregisters a blob reader and deletes the blob if it was
+// removed while open.
+func (s *S3Store) closeReader(ctx context.Context, id ObjectID) error {
+	s.mu.Lock()
+	s.readers[id]--
+	last := s.readers[id] <= 0
+	_, doomed := s.doomed[id]
+	if last {
+		delete(s.readers, id)
+		delete(s.doomed, id)
+	}
+	s.mu.Unlock()
+	if last && doomed {
+		return s.deleteKey(context.WithoutCancel(ctx), s.blobKey(id))
+	}
+	return nil
+}
+
+func (s *S3Store) readMeta(ctx context.Context, id ObjectID) (Meta, error) {
+	if err := checkID(id); err != nil {
+		return Meta{}, err
+	}
+	res, err := s.do(ctx, http.MethodGet, s.metaKey(id), nil, nil, nil)
+	if err != nil {
+		return Meta{}, err
+	}
+	defer res.Body.Close()
+	var m Meta
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return Meta{}, err
+	}
+	return m, nil
+}
+
+func (s *S3Store) writeMeta(ctx context.Context, id ObjectID, m Meta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.putObject(ctx, s.metaKey(id), b, "application/json")
+}
+
+// writeBlob uploads r to key, using a single PUT when it fits in one part
+// and multipart upload otherwise. It returns size and hex SHA-256.
+func (s *S3Store) writeBlob(ctx context.Context, key string, r io.Reader) (int64, string, error) {
+	h := sha256.New()
+	buf := make([]byte, s.cfg.PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		h.Write(buf[:n])
+		if err := s.putObject(ctx, key, buf[:n], "application/octet-stream"); err != nil {
+			return 0, "", err
+		}
+		return int64(n), hex.EncodeToString(h.Sum(nil)), nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	uploadID, err := s.createMultipart(ctx, key)
+	if err != nil {
+		return 0, "", err
+	}
+	var (
+		parts []s3Part
+		total int64
+	)
+	for num := 1; n > 0; num++ {
+		h.Write(buf[:n])
+		etag, err := s.uploadPart(ctx, key, uploadID, num, buf[:n])
+		if err != nil {
+			s.abortMultipart(context.WithoutCancel(ctx), key, uploadID)
+			return 0, "", err
+		}
+		parts = append(parts, s3Part{Number: num, ETag: etag})
+		total += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.abortMultipart(context.WithoutCancel(ctx), key, uploadID)
+			return 0, "", err
+		}
+	}
+	if err := s.completeMultipart(ctx, key, uploadID, parts); err != nil {
+		s.abortMultipart(context.WithoutCancel(ctx), key, uploadID)
+		return 0, "", err
+	}
+	return total, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type s3Part struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+}
+
+func (s *S3Store) createMultipart(ctx context.Context, key string) (string, error) {
+	res, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var out struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	if out.UploadID == "" {
+		return "", errors.New("s3: empty UploadId")
+	}
+	return out.UploadID, nil
+}
+
+func (s *S3Store) uploadPart(ctx context.Context, key, uploadID string, num int, body []byte) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadID}}
+	res, err := s.do(ctx, http.MethodPut, key, q, body, nil)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	return res.Header.Get("ETag"), nil
+}
+
+func (s *S3Store) completeMultipart(ctx context.Context, key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{"Content-Type": {"application/xml"}}
+	res, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, hdr)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// S3 may answer 200 and still report an error in the body.
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if e := parseS3Error(res.StatusCode, key, raw); e.Code != "" {
+		return e
+	}
+	return nil
+}
+
+func (s *S3Store) abortMultipart(ctx context.Context, key, uploadID string) {
+	res, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		res.Body.Close()
+	}
+}
+
+func (s *S3Store) putObject(ctx context.Context, key string, body []byte, contentType string) error {
+	res, err := s.do(ctx, http.MethodPut, key, nil, body, http.Header{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *S3Store) headObject(ctx context.Context, key string) (http.Header, error) {
+	res, err := s.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return res.Header, nil
+}
+
+// deleteKey removes key; deleting a missing key is not an error in S3.
+func (s *S3Store) deleteKey(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return res.Body.Close()
+}
+
+// listIDs returns the ids of all objects with metadata in the bucket.
+func (s *S3Store) listIDs(ctx context.Context) ([]ObjectID, error) {
+	prefix := s.cfg.Prefix + "meta/"
+	var ids []ObjectID
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		res, err := s.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range out.Contents {
+			name := strings.TrimSuffix(strings.TrimPrefix(c.Key, prefix), ".json")
+			if id, err := ParseObjectID(name); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		if !out.IsTruncated || out.NextContinuationToken == "" {
+			return ids, nil
+		}
+		token = out.NextContinuationToken
+	}
+}
+
+// objectURL addresses key in the bucket; key "" addresses the bucket itself.
+func (s *S3Store) objectURL(key string, q url.Values) *url.URL {
+	u := *s.base
+	if s.cfg.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawQuery = canonicalQuery(q)
+	return &u
+}
+
+// do sends a signed request and returns the response for any 2xx status.
+// Other statuses are returned as *S3Error with the body consumed.
+func (s *S3Store) do(ctx context.Context, method, key string, q url.Values, body []byte, hdr http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, q).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range hdr {
+		req.Header[k] = v
+	}
+	signV4(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.Region, hexSHA256(body), time.Now())
+	res, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	raw, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	return nil, parseS3Error(res.StatusCode, key, raw)
+}
+
+// S3Error is an error response from the S3 endpoint. 404s match
+// os.ErrNotExist so callers treat them like missing files.
+type S3Error struct {
+	Status  int
+	Code    string
+	Message string
+	Key     string
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3 %s: %d %s: %s", e.Key, e.Status, e.Code, e.Message)
+}
+
+func (e *S3Error) Is(target error) bool {
+	return target == os.ErrNotExist && e.Status == http.StatusNotFound
+}
+
+func parseS3Error(status int, key string, raw []byte) *S3Error {
+	var body struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	e := &S3Error{Status: status, Key: key}
+	if xml.Unmarshal(raw, &body) == nil && body.XMLName.Local == "Error" {
+		e.Code, e.Message = body.Code, body.Message
+	}
+	if status/100 != 2 && e.Code == "" {
+		e.Code = http.StatusText(status)
+	}
+	return e
+}
+
+// s3Reader is an io.ReadSeekCloser over a committed blob. Each Seek drops the
+// open response; the next Read issues a GET with Range from the new offset.
+type s3Reader struct {
+	s      *S3Store
+	ctx    context.Context
+	id     ObjectID
+	key    string
+	size   int64
+	pos    int64
+	body   io.ReadCloser
+	closed bool
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		hdr := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", r.pos, r.size-1)}}
+		res, err := r.s.do(r.ctx, http.MethodGet, r.key, nil, nil, hdr)
+		if err != nil {
+			return 0, err
+		}
+		r.body = res.Body
+	}
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+	if err == io.EOF && r.pos < r.size {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if pos != r.pos && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	return r.s.closeReader(r.ctx, r.id)
+}
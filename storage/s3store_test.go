@@ -0,0 +1,161 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+	"github.com/collapsinghierarchy/noisytransfer/storage/s3fake"
+	"github.com/collapsinghierarchy/noisytransfer/storage/storagetest"
+)
+
+// newS3Store returns a store backed by an in-process fake bucket.
+func newS3Store(t *testing.T) *storage.S3Store {
+	s, _, _ := newS3Fake(t)
+	return s
+}
+
+// newS3Fake also returns the fake and the bucket's URL, for inspecting and
+// tampering with objects.
+func newS3Fake(t *testing.T) (*storage.S3Store, *s3fake.Server, string) {
+	fake := s3fake.New()
+	ts := httptest.NewServer(fake)
+	t.Cleanup(ts.Close)
+	s, err := storage.NewS3Store(storage.S3Config{
+		Endpoint:  ts.URL,
+		Bucket:    "test",
+		PathStyle: true,
+		AccessKey: "access",
+		SecretKey: "secret",
+		Logger:    slog.New(slog.DiscardHandler),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake, ts.URL + "/test/"
+}
+
+func TestS3Store(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store { return newS3Store(t) })
+}
+
+func TestS3StoreGCSkipsCorruptMeta(t *testing.T) {
+	s, _, bucket := newS3Fake(t)
+	ctx := context.Background()
+	bad, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, good); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPut, bucket+"meta/"+string(bad)+".json", strings.NewReader("{not json"))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 test")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if err := s.GC(ctx, time.Nanosecond); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if _, err := s.StatBlob(ctx, good); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("tombstone after GC: %v, want os.ErrNotExist", err)
+	}
+}
+
+func hasKey(fake *s3fake.Server, key string) bool {
+	return slices.Contains(fake.Keys("test"), key)
+}
+
+func TestS3StoreAbortsFailedMultipart(t *testing.T) {
+	s, fake, _ := newS3Fake(t)
+	ctx := context.Background()
+	id, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// More than one part, so the upload is multipart when the reader fails.
+	r := io.MultiReader(bytes.NewReader(make([]byte, 9<<20)), iotest.ErrReader(errors.New("connection reset")))
+	if _, _, err := s.PutBlob(ctx, id, r); err == nil {
+		t.Fatal("PutBlob with failing reader: want error")
+	}
+	if n := fake.PendingUploads(); n != 0 {
+		t.Fatalf("%d multipart uploads left pending", n)
+	}
+	if hasKey(fake, "blobs/"+string(id)) {
+		t.Fatal("blob stored for a failed upload")
+	}
+	if m, err := s.StatBlob(ctx, id); err != nil || m.State != storage.StateCreated {
+		t.Fatalf("after failed upload: %+v, %v", m, err)
+	}
+}
+
+// TestS3StoreDeletesBlobAfterLastReader checks that a removed blob outlives
+// its open readers, and no longer.
+func TestS3StoreDeletesBlobAfterLastReader(t *testing.T) {
+	s, fake, _ := newS3Fake(t)
+	ctx := context.Background()
+	id, err := s.Create(ctx, storage.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.PutBlob(ctx, id, strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutManifest(ctx, id, strings.NewReader(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Commit(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	key := "blobs/" + string(id)
+	r1, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if hasKey(fake, "manifests/"+string(id)+".json") {
+		t.Fatal("manifest kept after delete")
+	}
+	// GC purging the tombstone must not take the blob from its readers.
+	if err := s.GC(ctx, time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r1); err != nil || string(got) != "data" {
+		t.Fatalf("first reader: %q, %v", got, err)
+	}
+	r1.Close()
+	if !hasKey(fake, key) {
+		t.Fatal("blob deleted while a reader is open")
+	}
+	if got, err := io.ReadAll(r2); err != nil || string(got) != "data" {
+		t.Fatalf("second reader: %q, %v", got, err)
+	}
+	r2.Close()
+	if hasKey(fake, key) {
+		t.Fatal("blob kept after its last reader closed")
+	}
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+)
+
+// State is the lifecycle state of an object.
+//
+//	created ──► uploading ──► uploaded ──► committed
+//	   ▲            │  ▲          │
+//	   └────────────┘  └──────────┘ (re-upload before commit)
+//
+// Any live state may move to expired or deleted; those two are terminal.
+type State string
+
+const (
+	StateCreated   State = "created"   // object exists, no blob yet
+	StateUploading State = "uploading" // a PutBlob is streaming
+	StateUploaded  State = "uploaded"  // blob staged, awaiting commit
+	StateCommitted State = "committed" // blob and manifest are final and readable
+	StateExpired   State = "expired"
+	StateDeleted   State = "deleted"
+)
+
+var transitions = map[State][]State{
+	StateCreated:   {StateUploading, StateExpired, StateDeleted},
+	StateUploading: {StateUploaded, StateCreated, StateExpired, StateDeleted},
+	StateUploaded:  {StateUploading, StateCommitted, StateExpired, StateDeleted},
+	StateCommitted: {StateExpired, StateDeleted},
+}
+
+// CanTransition reports whether an object in state s may move to state to.
+func (s State) CanTransition(to State) bool {
+	for _, t := range transitions[s] {
+		if t == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal reports whether s is a state no object can leave.
+func (s State) Terminal() bool { return s == StateExpired || s == StateDeleted }
+
+// Expired reports whether a live object has passed its ExpiresAt. An upload
+// in progress is never expired; it is rescheduled when the stream ends.
+func (m Meta) Expired(now time.Time) bool {
+	if m.State.Terminal() || m.State == StateUploading || m.ExpiresAt.IsZero() {
+		return false
+	}
+	return !now.Before(m.ExpiresAt)
+}
+
+// newMeta is the meta of an object created at now with opts.
+func newMeta(opts CreateOptions, now time.Time) Meta {
+	m := Meta{
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		State:          StateCreated,
+		OwnerHash:      opts.OwnerHash,
+		MaxDownloads:   opts.MaxDownloads,
+		UncommittedTTL: opts.UncommittedTTL,
+		CommittedTTL:   opts.CommittedTTL,
+		Deadline:       opts.ExpiresAt.UTC(),
+		Room:           opts.Room,
+		Client:         opts.Client,
+	}
+	m.scheduleExpiry(now)
+	return m
+}
+
+// scheduleExpiry sets ExpiresAt to now plus the TTL of the object's current
+// phase (uncommitted or committed), never later than Deadline.
+func (m *Meta) scheduleExpiry(now time.Time) {
+	ttl := m.UncommittedTTL
+	if m.State == StateCommitted {
+		ttl = m.CommittedTTL
+	}
+	var at time.Time
+	if ttl > 0 {
+		at = now.Add(ttl).UTC()
+	}
+	if !m.Deadline.IsZero() && (at.IsZero() || m.Deadline.Before(at)) {
+		at = m.Deadline
+	}
+	m.ExpiresAt = at
+}
+
+// ErrInvalidState is matched (errors.Is) by every *StateError.
+var ErrInvalidState = errors.New("operation not allowed in object state")
+
+// StateError is returned when an operation is not allowed in the object's
+// current state.
+type StateError struct {
+	ID    ObjectID
+	State State
+	Op    string
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("object %s is %s: %s not allowed", e.ID, e.State, e.Op)
+}
+
+func (e *StateError) Is(target error) bool { return target == ErrInvalidState }
+
+// ErrManifestMissing is returned by Commit when no manifest was uploaded.
+var ErrManifestMissing = errors.New("manifest missing")
+
+// ErrBlobIncomplete is returned by Commit when the blob upload ended before
+// the store recorded everything it needs to serve it; upload it again.
+var ErrBlobIncomplete = errors.New("blob upload incomplete")
+
+// transition moves m to state to on behalf of op, or returns a *StateError.
+func (m *Meta) transition(id ObjectID, op string, to State) error {
+	if !m.State.CanTransition(to) {
+		return &StateError{ID: id, State: m.State, Op: op}
+	}
+	m.State = to
+	m.Committed = to == StateCommitted
+	return nil
+}
+
+// requireMutable returns a *StateError unless the object is still being
+// assembled (created, uploading or uploaded).
+func (m *Meta) requireMutable(id ObjectID, op string) error {
+	switch m.State {
+	case StateCreated, StateUploading, StateUploaded:
+		return nil
+	}
+	return &StateError{ID: id, State: m.State, Op: op}
+}
+
+// setAttrs merges attrs into a copy of m.Attrs, so metas handed out earlier
+// never see the change.
+func (m *Meta) setAttrs(id ObjectID, attrs map[string]string) error {
+	if err := m.requireMutable(id, "set attrs"); err != nil {
+		return err
+	}
+	n := maps.Clone(m.Attrs)
+	if n == nil {
+		n = make(map[string]string, len(attrs))
+	}
+	maps.Copy(n, attrs)
+	m.Attrs = n
+	return nil
+}
+
+// gcAction is what a GC pass should do with one object.
+type gcAction int
+
+const (
+	gcKeep gcAction = iota
+	gcPurge
+	gcExpire
+	gcResetUpload
+)
+
+// gcDecide applies the GC rules shared by all stores: uploads are handed
+// back for the store to reset if no PutBlob is streaming them, tombstones are purged once older than ttl, objects without
+// any expiry fall back to being purged ttl after creation and anything past
+// ExpiresAt is tombstoned. A ttl <= 0 purges nothing.
+func gcDecide(m Meta, now time.Time, ttl time.Duration) gcAction {
+	switch {
+	case m.State.Terminal():
+		if ttl > 0 && now.Sub(m.UpdatedAt) >= ttl {
+			return gcPurge
+		}
+	case m.State == StateUploading:
+		return gcResetUpload
+	case m.ExpiresAt.IsZero():
+		if ttl > 0 && now.Sub(m.CreatedAt) >= ttl {
+			return gcPurge
+		}
+	case m.Expired(now):
+		return gcExpire
+	}
+	return gcKeep
+}
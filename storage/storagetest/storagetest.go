@@ -0,0 +1,710 @@
+// Package storagetest is a behavioral conformance suite for storage.Store.
+// A backend's tests call Run with a factory for fresh stores:
+//
+//	func TestFSStore(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Store {
+//			s, err := storage.NewFSStore(t.TempDir())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return s
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/storage"
+)
+
+// Factory returns a fresh, empty store. It is called once per subtest.
+type Factory func(t *testing.T) storage.Store
+
+// Run executes every conformance test against stores from newStore.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.Store)
+	}{
+		{"CreateAndStat", testCreateAndStat},
+		{"Ordering", testOrdering},
+		{"ReadBack", testReadBack},
+		{"ReUploadBeforeCommit", testReUploadBeforeCommit},
+		{"ConcurrentPutBlob", testConcurrentPutBlob},
+		{"ParallelObjects", testParallelObjects},
+		{"InterruptedUpload", testInterruptedUpload},
+		{"MissingIDs", testMissingIDs},
+		{"InvalidIDs", testInvalidIDs},
+		{"LargeStream", testLargeStream},
+		{"DeleteTombstone", testDeleteTombstone},
+		{"DownloadLimit", testDownloadLimit},
+		{"Deadline", testDeadline},
+		{"GCTTL", testGCTTL},
+		{"GCDuringUpload", testGCDuringUpload},
+		{"Usage", testUsage},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t))
+		})
+	}
+}
+
+func testCreateAndStat(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := create(t, s, storage.CreateOptions{OwnerHash: "owner", MaxDownloads: 3})
+	m, err := s.StatBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("StatBlob: %v", err)
+	}
+	if m.State != storage.StateCreated || m.Committed || m.Size != 0 {
+		t.Fatalf("fresh object: got state=%s committed=%v size=%d", m.State, m.Committed, m.Size)
+	}
+	if m.OwnerHash != "owner" || m.MaxDownloads != 3 {
+		t.Fatalf("create options not kept: %+v", m)
+	}
+	if m.CreatedAt.IsZero() {
+		t.Fatal("CreatedAt not set")
+	}
+	if id2 := create(t, s, storage.CreateOptions{}); id2 == id {
+		t.Fatal("Create returned a duplicate id")
+	}
+}
+
+func testOrdering(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := create(t, s, storage.CreateOptions{})
+
+	if _, err := s.Commit(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("commit before upload: want ErrInvalidState, got %v", err)
+	}
+	putBlob(t, s, id, []byte("payload"))
+	if _, err := s.Commit(ctx, id); !errors.Is(err, storage.ErrManifestMissing) {
+		t.Fatalf("commit without manifest: want ErrManifestMissing, got %v", err)
+	}
+	putManifest(t, s, id, `{"v":1}`)
+	m := commit(t, s, id)
+	if m.State != storage.StateCommitted || !m.Committed {
+		t.Fatalf("after commit: state=%s committed=%v", m.State, m.Committed)
+	}
+
+	if _, _, err := s.PutBlob(ctx, id, bytes.NewReader([]byte("late"))); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("upload after commit: want ErrInvalidState, got %v", err)
+	}
+	if err := s.PutManifest(ctx, id, bytes.NewReader([]byte("{}"))); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("manifest after commit: want ErrInvalidState, got %v", err)
+	}
+	if _, err := s.Commit(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("second commit: want ErrInvalidState, got %v", err)
+	}
+	// The committed content must be untouched by the rejected writes.
+	if got := readAll(t, s, id); string(got) != "payload" {
+		t.Fatalf("blob changed after rejected upload: %q", got)
+	}
+}
+
+func testReadBack(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	data := []byte("0123456789abcdefghij")
+	id := committed(t, s, data, `{"name":"x"}`)
+
+	m, err := s.StatBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("StatBlob: %v", err)
+	}
+	if m.Size != int64(len(data)) || m.ETag != sha(data) {
+		t.Fatalf("meta: size=%d etag=%s, want %d %s", m.Size, m.ETag, len(data), sha(data))
+	}
+
+	b, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	defer b.Close()
+	info := b.Info()
+	if info.Size != int64(len(data)) || info.ETag != sha(data) || info.ContentType == "" {
+		t.Fatalf("Info: %+v", info)
+	}
+	// Range-style access: seek around and read slices.
+	for _, r := range [][2]int64{{10, 5}, {0, 3}, {15, 5}, {19, 1}} {
+		if _, err := b.Seek(r[0], io.SeekStart); err != nil {
+			t.Fatalf("Seek(%d): %v", r[0], err)
+		}
+		got := make([]byte, r[1])
+		if _, err := io.ReadFull(b, got); err != nil {
+			t.Fatalf("read at %d: %v", r[0], err)
+		}
+		if want := data[r[0] : r[0]+r[1]]; !bytes.Equal(got, want) {
+			t.Fatalf("read at %d: got %q want %q", r[0], got, want)
+		}
+	}
+	if end, err := b.Seek(0, io.SeekEnd); err != nil || end != int64(len(data)) {
+		t.Fatalf("Seek end: %d, %v", end, err)
+	}
+
+	rc, err := s.GetManifest(ctx, id)
+	if err != nil {
+		t.Fatalf("GetManifest: %v", err)
+	}
+	man, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(man) != `{"name":"x"}` {
+		t.Fatalf("manifest: %q", man)
+	}
+}
+
+func testReUploadBeforeCommit(t *testing.T, s storage.Store) {
+	id := create(t, s, storage.CreateOptions{})
+	putBlob(t, s, id, []byte("first version, longer"))
+	putBlob(t, s, id, []byte("second"))
+	putManifest(t, s, id, `{}`)
+	m := commit(t, s, id)
+	if m.Size != 6 || m.ETag != sha([]byte("second")) {
+		t.Fatalf("re-upload: size=%d etag=%s", m.Size, m.ETag)
+	}
+	if got := readAll(t, s, id); string(got) != "second" {
+		t.Fatalf("re-upload content: %q", got)
+	}
+}
+
+// testConcurrentPutBlob checks that a second upload to the same object is
+// refused while the first is still streaming, and the first one wins.
+func testConcurrentPutBlob(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := create(t, s, storage.CreateOptions{})
+
+	gate := &gatedReader{data: []byte("winner"), started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.PutBlob(ctx, id, gate)
+		done <- err
+	}()
+	<-gate.started
+
+	m, err := s.StatBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("StatBlob during upload: %v", err)
+	}
+	if m.State != storage.StateUploading {
+		t.Fatalf("during upload: state=%s, want uploading", m.State)
+	}
+	if _, _, err := s.PutBlob(ctx, id, bytes.NewReader([]byte("loser"))); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("concurrent upload: want ErrInvalidState, got %v", err)
+	}
+	if _, err := s.Commit(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("commit during upload: want ErrInvalidState, got %v", err)
+	}
+	close(gate.release)
+	if err := <-done; err != nil {
+		t.Fatalf("first upload: %v", err)
+	}
+	putManifest(t, s, id, `{}`)
+	commit(t, s, id)
+	if got := readAll(t, s, id); string(got) != "winner" {
+		t.Fatalf("content: %q", got)
+	}
+}
+
+func testParallelObjects(t *testing.T, s storage.Store) {
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := context.Background()
+			id, err := s.Create(ctx, storage.CreateOptions{})
+			if err != nil {
+				errs <- err
+				return
+			}
+			data := bytes.Repeat([]byte{byte('a' + i)}, 1000+i)
+			if _, _, err := s.PutBlob(ctx, id, bytes.NewReader(data)); err != nil {
+				errs <- err
+				return
+			}
+			if err := s.PutManifest(ctx, id, bytes.NewReader([]byte("{}"))); err != nil {
+				errs <- err
+				return
+			}
+			m, err := s.Commit(ctx, id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if m.ETag != sha(data) {
+				errs <- fmt.Errorf("object %d: etag mismatch", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// testInterruptedUpload simulates a client or process dying mid-stream: the
+// object must fall back to created with nothing readable, and accept a
+// fresh upload afterwards.
+func testInterruptedUpload(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := create(t, s, storage.CreateOptions{})
+	putBlob(t, s, id, []byte("staged earlier"))
+
+	broken := io.MultiReader(bytes.NewReader(bytes.Repeat([]byte("x"), 4096)), errReader{errors.New("connection reset")})
+	if _, _, err := s.PutBlob(ctx, id, broken); err == nil {
+		t.Fatal("PutBlob with failing reader: want error")
+	}
+	m, err := s.StatBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("StatBlob: %v", err)
+	}
+	if m.State != storage.StateCreated || m.Size != 0 || m.ETag != "" {
+		t.Fatalf("after failed upload: state=%s size=%d etag=%q", m.State, m.Size, m.ETag)
+	}
+	putManifest(t, s, id, `{}`)
+	if _, err := s.Commit(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("commit after failed upload: want ErrInvalidState, got %v", err)
+	}
+
+	putBlob(t, s, id, []byte("retry"))
+	commit(t, s, id)
+	if got := readAll(t, s, id); string(got) != "retry" {
+		t.Fatalf("content after retry: %q", got)
+	}
+}
+
+func testMissingIDs(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	const id storage.ObjectID = "00000000-0000-4000-8000-000000000000"
+	check := func(op string, err error) {
+		t.Helper()
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s on missing id: want os.ErrNotExist, got %v", op, err)
+		}
+	}
+	_, _, err := s.PutBlob(ctx, id, bytes.NewReader([]byte("x")))
+	check("PutBlob", err)
+	check("PutManifest", s.PutManifest(ctx, id, bytes.NewReader([]byte("{}"))))
+	_, err = s.Commit(ctx, id)
+	check("Commit", err)
+	_, err = s.StatBlob(ctx, id)
+	check("StatBlob", err)
+	_, err = s.OpenBlob(ctx, id)
+	check("OpenBlob", err)
+	_, err = s.GetManifest(ctx, id)
+	check("GetManifest", err)
+	_, err = s.RecordDownload(ctx, id)
+	check("RecordDownload", err)
+	check("Delete", s.Delete(ctx, id))
+}
+
+// testInvalidIDs feeds ids that could escape a directory or key prefix
+// straight into the store, bypassing ParseObjectID.
+func testInvalidIDs(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	for _, raw := range []string{
+		"", ".", "..", "../objects", "../../etc/passwd", "/abs",
+		"00000000-0000-4000-8000-00000000000/", "00000000-0000-4000-8000-00000000000\\",
+		"00000000-0000-4000-8000-0000000000000", "00000000-0000-4000-8000-00000000000A",
+		"00000000/0000-4000-8000-000000000000",
+	} {
+		id := storage.ObjectID(raw)
+		check := func(op string, err error) {
+			t.Helper()
+			if !errors.Is(err, storage.ErrInvalidID) {
+				t.Errorf("%s(%q): want ErrInvalidID, got %v", op, raw, err)
+			}
+		}
+		_, _, err := s.PutBlob(ctx, id, bytes.NewReader([]byte("x")))
+		check("PutBlob", err)
+		check("PutManifest", s.PutManifest(ctx, id, bytes.NewReader([]byte("{}"))))
+		_, err = s.Commit(ctx, id)
+		check("Commit", err)
+		_, err = s.StatBlob(ctx, id)
+		check("StatBlob", err)
+		_, err = s.OpenBlob(ctx, id)
+		check("OpenBlob", err)
+		_, err = s.GetManifest(ctx, id)
+		check("GetManifest", err)
+		_, err = s.RecordDownload(ctx, id)
+		check("RecordDownload", err)
+		check("Delete", s.Delete(ctx, id))
+	}
+}
+
+func testLargeStream(t *testing.T, s storage.Store) {
+	if testing.Short() {
+		t.Skip("large stream skipped in -short mode")
+	}
+	ctx := context.Background()
+	const size = 20<<20 + 7 // crosses typical buffer and multipart boundaries
+	id := create(t, s, storage.CreateOptions{})
+	h := sha256.New()
+	n, etag, err := s.PutBlob(ctx, id, io.TeeReader(io.LimitReader(&patternReader{}, size), h))
+	if err != nil {
+		t.Fatalf("PutBlob: %v", err)
+	}
+	want := hex.EncodeToString(h.Sum(nil))
+	if n != size || etag != want {
+		t.Fatalf("PutBlob: n=%d etag=%s, want %d %s", n, etag, size, want)
+	}
+	putManifest(t, s, id, `{}`)
+	commit(t, s, id)
+
+	b, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	defer b.Close()
+	rh := sha256.New()
+	if got, err := io.Copy(rh, b); err != nil || got != size {
+		t.Fatalf("read back: n=%d err=%v", got, err)
+	}
+	if hex.EncodeToString(rh.Sum(nil)) != want {
+		t.Fatal("read back: content mismatch")
+	}
+	// A read near the end must not require streaming from the start.
+	if _, err := b.Seek(size-3, io.SeekStart); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	tail := make([]byte, 3)
+	if _, err := io.ReadFull(b, tail); err != nil {
+		t.Fatalf("tail: %v", err)
+	}
+	var exp [3]byte
+	for i := range exp {
+		exp[i] = patternByte(size - 3 + int64(i))
+	}
+	if !bytes.Equal(tail, exp[:]) {
+		t.Fatalf("tail: got %v want %v", tail, exp)
+	}
+}
+
+func testDeleteTombstone(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := committed(t, s, []byte("secret"), `{}`)
+	b, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	defer b.Close()
+	if err := s.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got, err := io.ReadAll(b); err != nil || string(got) != "secret" {
+		t.Fatalf("reader opened before delete: %q, %v", got, err)
+	}
+	m, err := s.StatBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("StatBlob after delete: want tombstone, got %v", err)
+	}
+	if m.State != storage.StateDeleted {
+		t.Fatalf("after delete: state=%s", m.State)
+	}
+	if _, err := s.OpenBlob(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("OpenBlob after delete: want ErrInvalidState, got %v", err)
+	}
+	if _, err := s.GetManifest(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("GetManifest after delete: want ErrInvalidState, got %v", err)
+	}
+	if err := s.Delete(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("second Delete: want ErrInvalidState, got %v", err)
+	}
+}
+
+func testDownloadLimit(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := create(t, s, storage.CreateOptions{MaxDownloads: 2})
+	putBlob(t, s, id, []byte("twice"))
+	putManifest(t, s, id, `{}`)
+	commit(t, s, id)
+
+	m, err := s.RecordDownload(ctx, id)
+	if err != nil || m.Downloads != 1 || m.State != storage.StateCommitted {
+		t.Fatalf("first download: %+v, %v", m, err)
+	}
+	// The last download is still streaming when it is recorded; like any
+	// reader that opened the blob before it went away, it must finish.
+	b, err := s.OpenBlob(ctx, id)
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	defer b.Close()
+	m, err = s.RecordDownload(ctx, id)
+	if err != nil || m.Downloads != 2 || m.State != storage.StateExpired {
+		t.Fatalf("last download: %+v, %v", m, err)
+	}
+	if got, err := io.ReadAll(b); err != nil || string(got) != "twice" {
+		t.Fatalf("reading the last download after expiry: %q, %v", got, err)
+	}
+	if _, err := s.OpenBlob(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("OpenBlob after limit: want ErrInvalidState, got %v", err)
+	}
+	if _, err := s.RecordDownload(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("RecordDownload after limit: want ErrInvalidState, got %v", err)
+	}
+}
+
+func testDeadline(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := create(t, s, storage.CreateOptions{ExpiresAt: time.Now().Add(150 * time.Millisecond)})
+	putBlob(t, s, id, []byte("soon gone"))
+	putManifest(t, s, id, `{}`)
+	m := commit(t, s, id)
+	if m.ExpiresAt.IsZero() {
+		t.Fatal("ExpiresAt not reported")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if m, err := s.StatBlob(ctx, id); err != nil || m.State != storage.StateExpired {
+		t.Fatalf("after deadline: %+v, %v", m, err)
+	}
+	if _, err := s.OpenBlob(ctx, id); !errors.Is(err, storage.ErrInvalidState) {
+		t.Fatalf("OpenBlob after deadline: want ErrInvalidState, got %v", err)
+	}
+}
+
+func testGCTTL(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	stale := create(t, s, storage.CreateOptions{UncommittedTTL: 100 * time.Millisecond})
+	kept := create(t, s, storage.CreateOptions{UncommittedTTL: 100 * time.Millisecond, CommittedTTL: time.Hour})
+	putBlob(t, s, kept, []byte("keep me"))
+	putManifest(t, s, kept, `{}`)
+	commit(t, s, kept)
+	time.Sleep(150 * time.Millisecond)
+
+	if err := s.GC(ctx, time.Hour); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if m, err := s.StatBlob(ctx, stale); err != nil || m.State != storage.StateExpired {
+		t.Fatalf("uncommitted past TTL: want expired tombstone, got %+v, %v", m, err)
+	}
+	if m, err := s.StatBlob(ctx, kept); err != nil || m.State != storage.StateCommitted {
+		t.Fatalf("committed within TTL: %+v, %v", m, err)
+	}
+
+	// A zero ttl disables purging.
+	if err := s.GC(ctx, 0); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if m, err := s.StatBlob(ctx, stale); err != nil || m.State != storage.StateExpired {
+		t.Fatalf("tombstone after GC(0): want it kept, got %+v, %v", m, err)
+	}
+
+	// Tombstones are purged once older than the GC ttl.
+	if err := s.GC(ctx, time.Nanosecond); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if _, err := s.StatBlob(ctx, stale); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("tombstone after GC: want os.ErrNotExist, got %v", err)
+	}
+	if got := readAll(t, s, kept); string(got) != "keep me" {
+		t.Fatalf("committed object after GC: %q", got)
+	}
+}
+
+// testGCDuringUpload runs GC while an object without any expiry is
+// streaming; the upload must survive it.
+func testGCDuringUpload(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+	id := create(t, s, storage.CreateOptions{CommittedTTL: time.Hour})
+
+	gate := &gatedReader{data: []byte("streaming"), started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.PutBlob(ctx, id, gate)
+		done <- err
+	}()
+	<-gate.started
+
+	time.Sleep(time.Millisecond)
+	if err := s.GC(ctx, time.Nanosecond); err != nil {
+		t.Fatalf("GC: %v", err)
+	}
+	if m, err := s.StatBlob(ctx, id); err != nil || m.State != storage.StateUploading {
+		t.Fatalf("after GC during upload: %+v, %v", m, err)
+	}
+	close(gate.release)
+	if err := <-done; err != nil {
+		t.Fatalf("upload across GC: %v", err)
+	}
+	putManifest(t, s, id, `{}`)
+	commit(t, s, id)
+	if got := readAll(t, s, id); string(got) != "streaming" {
+		t.Fatalf("content: %q", got)
+	}
+}
+
+// testUsage checks the counters of stores that implement storage.Accountant:
+// per owner, room and client, with a re-upload releasing the staged blob it
+// replaces while the new one streams.
+func testUsage(t *testing.T, s storage.Store) {
+	acct, ok := s.(storage.Accountant)
+	if !ok {
+		t.Skip("not an Accountant")
+	}
+	ctx := context.Background()
+	usage := func() (owner, room, client storage.Usage) {
+		t.Helper()
+		owner, _, err := acct.Usage("owner")
+		if errors.Is(err, errors.ErrUnsupported) {
+			t.Skip("usage not tracked") // a wrapper over a store without accounting
+		}
+		if err != nil {
+			t.Fatalf("Usage: %v", err)
+		}
+		room, client, err = acct.GroupUsage("room", "client")
+		if err != nil {
+			t.Fatalf("GroupUsage: %v", err)
+		}
+		return owner, room, client
+	}
+	id := create(t, s, storage.CreateOptions{OwnerHash: "owner", Room: "room", Client: "client"})
+	create(t, s, storage.CreateOptions{OwnerHash: "other", Room: "elsewhere", Client: "someone"})
+	putBlob(t, s, id, bytes.Repeat([]byte("x"), 1000))
+	o, r, c := usage()
+	if o.Objects != 1 || r.Objects != 1 || c.Objects != 1 || o.Bytes < 1000 || r.Bytes != o.Bytes || c.Bytes != o.Bytes {
+		t.Fatalf("after upload: owner %+v, room %+v, client %+v", o, r, c)
+	}
+
+	gate := &gatedReader{data: []byte("smaller"), started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.PutBlob(ctx, id, gate)
+		done <- err
+	}()
+	<-gate.started
+	if o, r, c := usage(); o.Bytes != 0 || r.Bytes != 0 || c.Bytes != 0 {
+		t.Fatalf("during re-upload: owner %+v, room %+v, client %+v; want the staged blob released", o, r, c)
+	}
+	close(gate.release)
+	if err := <-done; err != nil {
+		t.Fatalf("re-upload: %v", err)
+	}
+	if o, _, _ := usage(); o.Bytes == 0 || o.Bytes >= 1000 {
+		t.Fatalf("after re-upload: owner %+v", o)
+	}
+
+	if err := s.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if o, r, c := usage(); o.Objects != 0 || r.Objects != 0 || c.Objects != 0 {
+		t.Fatalf("after delete: owner %+v, room %+v, client %+v", o, r, c)
+	}
+}
+
+// helpers
+
+func create(t *testing.T, s storage.Store, opts storage.CreateOptions) storage.ObjectID {
+	t.Helper()
+	id, err := s.Create(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return id
+}
+
+func putBlob(t *testing.T, s storage.Store, id storage.ObjectID, data []byte) {
+	t.Helper()
+	n, etag, err := s.PutBlob(context.Background(), id, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("PutBlob: %v", err)
+	}
+	if n != int64(len(data)) || etag != sha(data) {
+		t.Fatalf("PutBlob: n=%d etag=%s, want %d %s", n, etag, len(data), sha(data))
+	}
+}
+
+func putManifest(t *testing.T, s storage.Store, id storage.ObjectID, manifest string) {
+	t.Helper()
+	if err := s.PutManifest(context.Background(), id, bytes.NewReader([]byte(manifest))); err != nil {
+		t.Fatalf("PutManifest: %v", err)
+	}
+}
+
+func commit(t *testing.T, s storage.Store, id storage.ObjectID) storage.Meta {
+	t.Helper()
+	m, err := s.Commit(context.Background(), id)
+	if err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	return m
+}
+
+func committed(t *testing.T, s storage.Store, data []byte, manifest string) storage.ObjectID {
+	t.Helper()
+	id := create(t, s, storage.CreateOptions{})
+	putBlob(t, s, id, data)
+	putManifest(t, s, id, manifest)
+	commit(t, s, id)
+	return id
+}
+
+func readAll(t *testing.T, s storage.Store, id storage.ObjectID) []byte {
+	t.Helper()
+	b, err := s.OpenBlob(context.Background(), id)
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	defer b.Close()
+	data, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatalf("read blob: %v", err)
+	}
+	return data
+}
+
+func sha(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// gatedReader signals when the store starts reading and then blocks until
+// released, holding the upload open.
+type gatedReader struct {
+	data     []byte
+	started  chan struct{}
+	release  chan struct{}
+	once     sync.Once
+	consumed bool
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	g.once.Do(func() { close(g.started) })
+	<-g.release
+	if g.consumed {
+		return 0, io.EOF
+	}
+	g.consumed = true
+	return copy(p, g.data), nil
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+// patternReader yields an endless deterministic byte stream.
+type patternReader struct{ off int64 }
+
+func (p *patternReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = patternByte(p.off)
+		p.off++
+	}
+	return len(b), nil
+}
+
+func patternByte(off int64) byte { return byte(off*31 + off>>8) }
@@ -0,0 +1,202 @@
+package turn
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets are the shared secrets of ephemeral TURN credentials in the TURN
+// REST API format (draft-uberti-behave-turn-rest): the username is
+// "<expiry unix time>:<user>" and the password is the base64 HMAC-SHA1 of
+// the username under the secret. The user part is
+// "<id>/<appID>/<side>/<issued>": the id of the signing secret, so a
+// credential is checked against the secret that issued it, the hub room and
+// side it was issued to, and the issue time in unix milliseconds. Revoke ends
+// the credentials a room was issued so far.
+//
+// The secret file has one "<id> <secret>" per line; blank lines and lines
+// starting with # are ignored. The last secret is the active one, so a
+// rotation appends a line (see "noisytransferd genkey") and reloads. The old
+// secret keeps verifying the credentials it signed until it is removed, which
+// is safe once the credential TTL has passed.
+type Secrets struct {
+	path string
+
+	mu      sync.RWMutex
+	active  string
+	keys    map[string][]byte
+	revoked map[string]time.Time // appID -> when
+	maxTTL  time.Duration        // longest lifetime issued; bounds revoked entries
+}
+
+// LoadSecrets reads a secret file.
+func LoadSecrets(path string) (*Secrets, error) {
+	s := &Secrets{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// RandomSecrets returns a single secret that lives as long as the process,
+// for deployments where nothing outside it checks the credentials.
+func RandomSecrets() *Secrets {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &Secrets{active: "r", keys: map[string][]byte{"r": key}}
+}
+
+// Reload re-reads the secret file. On error the current secrets stay.
+func (s *Secrets) Reload() error {
+	if s.path == "" {
+		return errors.New("secrets were not loaded from a file")
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := make(map[string][]byte)
+	var active string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, ok := strings.Cut(line, " ")
+		secret = strings.TrimSpace(secret)
+		if !ok || id == "" || len(id) > 64 || strings.ContainsAny(id, ":/") || secret == "" {
+			return fmt.Errorf("%s:%d: want \"<id> <secret>\" with no ':' or '/' in the id", s.path, n)
+		}
+		if _, dup := keys[id]; dup {
+			return fmt.Errorf("%s:%d: duplicate secret id %q", s.path, n, id)
+		}
+		keys[id] = []byte(secret)
+		active = id
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if active == "" {
+		return fmt.Errorf("%s: no secrets", s.path)
+	}
+	s.mu.Lock()
+	s.active, s.keys = active, keys
+	s.mu.Unlock()
+	return nil
+}
+
+// Active returns the id of the secret new credentials are signed with.
+func (s *Secrets) Active() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// Credential is a TURN username and password.
+type Credential struct {
+	Username string
+	Password string
+	Expires  time.Time
+}
+
+// Issue signs a credential for side of room appID, valid for ttl.
+func (s *Secrets) Issue(appID, side string, ttl time.Duration) Credential {
+	s.mu.Lock()
+	id, key := s.active, s.keys[s.active]
+	s.maxTTL = max(s.maxTTL, ttl)
+	s.mu.Unlock()
+	now := time.Now()
+	exp := now.Add(ttl).Truncate(time.Second)
+	user := strconv.FormatInt(exp.Unix(), 10) + ":" + id + "/" + appID + "/" + side + "/" +
+		strconv.FormatInt(now.UnixMilli(), 10)
+	return Credential{Username: user, Password: sign(key, user), Expires: exp}
+}
+
+// Revoke invalidates the credentials issued for room appID until now, as when
+// the hub forgets the room. Credentials issued later, to a room of the same
+// id, are not affected.
+func (s *Secrets) Revoke(appID string) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revoked == nil {
+		s.revoked = make(map[string]time.Time)
+	}
+	s.revoked[appID] = now
+	// Entries older than any credential's lifetime guard nothing.
+	for k, at := range s.revoked {
+		if now.Sub(at) > s.maxTTL {
+			delete(s.revoked, k)
+		}
+	}
+}
+
+// Password returns the password of a username issued by Issue, or false if
+// it is malformed, expired, revoked or signed with a secret no longer held.
+func (s *Secrets) Password(username string) (string, bool) {
+	u, ok := ParseUsername(username)
+	if !ok || time.Now().After(u.Expires) {
+		return "", false
+	}
+	s.mu.RLock()
+	key, ok := s.keys[u.SecretID]
+	at, revoked := s.revoked[u.AppID]
+	s.mu.RUnlock()
+	if !ok || revoked && !u.Issued.After(at) {
+		return "", false
+	}
+	return sign(key, username), true
+}
+
+// Username is a parsed credential username.
+type Username struct {
+	Expires     time.Time
+	SecretID    string
+	AppID, Side string
+	Issued      time.Time
+}
+
+// ParseUsername splits "<expiry>:<id>/<appID>/<side>/<issued>".
+func ParseUsername(username string) (Username, bool) {
+	ts, user, ok := strings.Cut(username, ":")
+	if !ok {
+		return Username{}, false
+	}
+	exp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return Username{}, false
+	}
+	parts := strings.Split(user, "/")
+	if len(parts) != 4 || parts[1] == "" || parts[2] == "" {
+		return Username{}, false
+	}
+	issued, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return Username{}, false
+	}
+	return Username{
+		Expires:  time.Unix(exp, 0),
+		SecretID: parts[0],
+		AppID:    parts[1],
+		Side:     parts[2],
+		Issued:   time.UnixMilli(issued),
+	}, true
+}
+
+func sign(key []byte, username string) string {
+	mac := hmac.New(sha1.New, key)
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
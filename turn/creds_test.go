@@ -0,0 +1,174 @@
+package turn_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/collapsinghierarchy/noisytransfer/turn"
+)
+
+func TestParseUsername(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want turn.Username
+		ok   bool
+	}{
+		{"Valid", "1700000000:k1/room/A/1699999000123", turn.Username{
+			Expires:  time.Unix(1700000000, 0),
+			SecretID: "k1",
+			AppID:    "room",
+			Side:     "A",
+			Issued:   time.UnixMilli(1699999000123),
+		}, true},
+		{"NoExpiry", "k1/room/A/1", turn.Username{}, false},
+		{"BadExpiry", "soon:k1/room/A/1", turn.Username{}, false},
+		{"TooFewParts", "1700000000:k1/room/A", turn.Username{}, false},
+		{"TooManyParts", "1700000000:k1/room/A/1/x", turn.Username{}, false},
+		{"EmptyAppID", "1700000000:k1//A/1", turn.Username{}, false},
+		{"EmptySide", "1700000000:k1/room//1", turn.Username{}, false},
+		{"BadIssued", "1700000000:k1/room/A/now", turn.Username{}, false},
+		{"Empty", "", turn.Username{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := turn.ParseUsername(tc.in)
+			if ok != tc.ok || !got.Expires.Equal(tc.want.Expires) || !got.Issued.Equal(tc.want.Issued) ||
+				got.SecretID != tc.want.SecretID || got.AppID != tc.want.AppID || got.Side != tc.want.Side {
+				t.Fatalf("ParseUsername(%q) = %+v, %v; want %+v, %v", tc.in, got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+func TestIssue(t *testing.T) {
+	s := turn.RandomSecrets()
+	before := time.Now()
+	c := s.Issue("room", "B", time.Hour)
+
+	u, ok := turn.ParseUsername(c.Username)
+	if !ok {
+		t.Fatalf("issued username %q does not parse", c.Username)
+	}
+	if u.SecretID != s.Active() || u.AppID != "room" || u.Side != "B" {
+		t.Fatalf("issued username %q: %+v", c.Username, u)
+	}
+	if !u.Expires.Equal(c.Expires) || c.Expires.Before(before.Add(time.Hour-time.Second)) || c.Expires.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expires %v, want about an hour from %v", c.Expires, before)
+	}
+	if pass, ok := s.Password(c.Username); !ok || pass != c.Password {
+		t.Fatalf("Password(issued) = %q, %v; want %q", pass, ok, c.Password)
+	}
+
+	// The password is bound to every part of the username.
+	forged := turn.RandomSecrets().Issue("room", "B", time.Hour)
+	if pass, ok := s.Password(forged.Username); ok && pass == forged.Password {
+		t.Fatal("credential of another secret accepted")
+	}
+	other := s.Issue("other", "B", time.Hour)
+	if pass, _ := s.Password(other.Username); pass == c.Password {
+		t.Fatal("credentials of different rooms share a password")
+	}
+
+	expired := s.Issue("room", "A", -time.Second)
+	if _, ok := s.Password(expired.Username); ok {
+		t.Fatal("expired credential accepted")
+	}
+	if _, ok := s.Password("garbage"); ok {
+		t.Fatal("malformed username accepted")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	s := turn.RandomSecrets()
+	old := s.Issue("room", "A", time.Hour)
+	bystander := s.Issue("other", "A", time.Hour)
+	time.Sleep(2 * time.Millisecond) // issue times have millisecond resolution
+
+	s.Revoke("room")
+	if _, ok := s.Password(old.Username); ok {
+		t.Fatal("credential issued before Revoke accepted")
+	}
+	if _, ok := s.Password(bystander.Username); !ok {
+		t.Fatal("credential of another room refused")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if fresh := s.Issue("room", "A", time.Hour); !verifies(s, fresh) {
+		t.Fatal("credential issued after Revoke refused")
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "turn.secrets")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# rotated by hand\nk1 first-secret\n\n")
+	s, err := turn.LoadSecrets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() != "k1" {
+		t.Fatalf("active %q, want k1", s.Active())
+	}
+	c1 := s.Issue("room", "A", time.Hour)
+
+	// A rotation appends a secret; what the old one signed still verifies.
+	write("k1 first-secret\nk2 second-secret\n")
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() != "k2" {
+		t.Fatalf("active %q after rotation, want k2", s.Active())
+	}
+	c2 := s.Issue("room", "A", time.Hour)
+	if u, _ := turn.ParseUsername(c2.Username); u.SecretID != "k2" {
+		t.Fatalf("issued with %q after rotation, want k2", u.SecretID)
+	}
+	if !verifies(s, c1) || !verifies(s, c2) {
+		t.Fatal("credential refused after rotation")
+	}
+
+	// A broken file leaves the current secrets in place.
+	for _, bad := range []string{
+		"",
+		"# only comments\n",
+		"k3\n",
+		"k:3 secret\n",
+		"k/3 secret\n",
+		"k2 a\nk2 b\n",
+	} {
+		write(bad)
+		if err := s.Reload(); err == nil {
+			t.Fatalf("Reload accepted %q", bad)
+		}
+		if s.Active() != "k2" || !verifies(s, c1) {
+			t.Fatalf("secrets changed by failed Reload of %q", bad)
+		}
+	}
+
+	// Removing a secret ends the credentials it signed.
+	write("k2 second-secret\n")
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if verifies(s, c1) {
+		t.Fatal("credential of a removed secret accepted")
+	}
+	if !verifies(s, c2) {
+		t.Fatal("credential of the kept secret refused")
+	}
+
+	if err := turn.RandomSecrets().Reload(); err == nil {
+		t.Fatal("Reload of random secrets succeeded")
+	}
+}
+
+func verifies(s *turn.Secrets, c turn.Credential) bool {
+	pass, ok := s.Password(c.Username)
+	return ok && pass == c.Password
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/pion/turn/v4"
@@ -13,8 +14,19 @@ import (
 )
 
 type Config struct {
-	Realm, Username, Password string
-	Logger                    *slog.Logger
+	Realm   string
+	Secrets *Secrets // verify the ephemeral credentials handed out with Issue
+	// MaxAllocation bounds how long a credential keeps authenticating after
+	// its first use; 0 leaves only its expiry. Refreshes, permissions and
+	// channel binds all authenticate, so an allocation whose credential is
+	// refused (or revoked with its room) dies within the permission lifetime
+	// of five minutes.
+	MaxAllocation time.Duration
+	// RoomLive, if set, reports whether the peers of a room are still
+	// around; the credentials of any other room are refused, which also
+	// covers revocations lost to a restart.
+	RoomLive func(appID string) bool
+	Logger   *slog.Logger
 }
 
 func Start(ctx context.Context, cfg Config) error {
@@ -28,11 +40,24 @@ func Start(ctx context.Context, cfg Config) error {
 	}
 
 	// ----- auth --------------------------------------------------------------
-	auth := func(user, realm string, _ net.Addr) ([]byte, bool) {
-		if user != cfg.Username {
+	firstUse := &firstUses{seen: make(map[string]time.Time)}
+	auth := func(user, realm string, src net.Addr) ([]byte, bool) {
+		pass, ok := cfg.Secrets.Password(user)
+		if !ok {
+			cfg.Logger.Debug("turn auth refused", "user", user, "src", src)
 			return nil, false
 		}
-		return turn.GenerateAuthKey(user, realm, cfg.Password), true
+		if cfg.RoomLive != nil {
+			if u, _ := ParseUsername(user); !cfg.RoomLive(u.AppID) {
+				cfg.Logger.Debug("turn credential of a closed room", "user", user, "src", src)
+				return nil, false
+			}
+		}
+		if cfg.MaxAllocation > 0 && time.Since(firstUse.get(user)) > cfg.MaxAllocation {
+			cfg.Logger.Debug("turn credential past max allocation", "user", user, "src", src)
+			return nil, false
+		}
+		return turn.GenerateAuthKey(user, realm, pass), true
 	}
 
 	// ----- Relay port-range --------------------------------------------------
@@ -70,3 +95,30 @@ func Start(ctx context.Context, cfg Config) error {
 	srv.Close()
 	return nil
 }
+
+// firstUses remembers when each credential first authenticated.
+type firstUses struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+func (f *firstUses) get(user string) time.Time {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.lastSweep) > time.Minute {
+		f.lastSweep = now
+		for u := range f.seen {
+			if p, ok := ParseUsername(u); !ok || now.After(p.Expires) {
+				delete(f.seen, u)
+			}
+		}
+	}
+	t, ok := f.seen[user]
+	if !ok {
+		t = now
+		f.seen[user] = t
+	}
+	return t
+}